@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	abortwindow  = 10 * time.Minute // Players may vote to abort this soon after a start.
+	noshowsfile  = "pickupnoshows.log"
+	noshowperiod = 30 * 24 * time.Hour // No-shows older than this are forgiven.
+	noshowlimit  = 3                   // No-shows in noshowperiod that earn a ban.
+	noshowban    = 24 * time.Hour      // Ban for each no-show at or over the limit.
+)
+
+func abort(where, who string, args ...string) bool {
+	if len(args) > 1 {
+		sayusage(where, who, "usage: !abort [id|mode]")
+		return false
+	}
+	game := ""
+	if len(args) == 1 {
+		game = args[0]
+	}
+	id, _ := strconv.Atoi(strings.TrimPrefix(game, "#"))
+	op := irc.isopped(who, channel)
+	var g *Game
+	for i := len(games) - 1; i >= 0 && g == nil; i-- {
+		gg := games[i]
+		if !gg.active() ||
+			(game != "" && gg.id != id && !strings.EqualFold(gg.name, game)) {
+			continue
+		}
+		if (op && game != "") || gg.playerindex(who) >= 0 {
+			g = gg
+		}
+	}
+	if g == nil {
+		sayusage(where, who, "no such game")
+		return false
+	}
+	if op {
+		g.abort()
+		return true
+	}
+	if time.Since(g.started) > abortwindow {
+		sayusage(where, who, "it's too late to abort that game; ask an op")
+		return false
+	}
+	g.abortvotes[who] = true
+	if 2*len(g.abortvotes) > len(g.who) {
+		g.abort()
+		return true
+	}
+	irc.privmsg(channel, csprintf("{orange}{b}%s{b} #%d{r} abort votes: {orange}%d/%d{r}; !abort to agree",
+		g.name, g.id, len(g.abortvotes), len(g.who)/2+1))
+	return true
+}
+
+// Call off game g, or its draft: strike it from the history and put the
+// players back in the modes they were added to before it started.
+func (g *Game) abort() {
+	if g.draft != nil {
+		g.draft.gen++ // Cancel the pick timeout.
+		g.draft = nil
+	}
+	g.vote = nil
+	if g.state >= Playing {
+		if err := hist.edit(g.id, func(*HistVal) bool { return false }); err != nil {
+			log.Println(err)
+		}
+	}
+	removegame(g)
+	for k, prev := range g.prev {
+		mm, ok := modes[k]
+		if !ok {
+			continue
+		}
+		who := make([]Player, 0, len(prev)+len(mm.who))
+		for _, u := range prev {
+			if !busy(u.user, g) && findban(u.user) == nil {
+				u.captain = false
+				who = append(who, u)
+			}
+		}
+		for _, u := range mm.who {
+			if findplayer(who, u.user) < 0 {
+				who = append(who, u)
+			}
+		}
+		mm.who = who
+	}
+	irc.privmsg(channel, csprintf("{orange}{b}%s{b} #%d{r} was aborted; its players have been put back",
+		g.name, g.id))
+	updatetopic()
+	if m := g.cupmatch; m != nil && m.game == g {
+		m.game, m.held = nil, true
+		irc.privmsg(channel, csprintf("{orange}{b}%s{b}{r} cup match #%d is on hold until an operator "+
+			"replays or awards it, or a player forfeits it", m.cup.name, m.num))
+		m.cup.export()
+	}
+}
+
+// Is who in an active game other than g that started later?
+func busy(who string, g *Game) bool {
+	for _, gg := range games {
+		if gg != g && gg.active() && !gg.started.Before(g.started) && gg.playerindex(who) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Record that a player didn't turn up for a game, banning them if they
+// make a habit of it.
+func noshow(where, who string, args ...string) bool {
+	if len(args) < 1 || len(args) > 2 {
+		sayusage(where, who, "usage: !noshow nick [id]")
+		return false
+	}
+	id := 0
+	if len(args) == 2 {
+		id, _ = strconv.Atoi(strings.TrimPrefix(args[1], "#"))
+	}
+	var g *Game
+	var name string
+	for i := len(games) - 1; i >= 0 && g == nil; i-- {
+		if games[i].state < Playing || (id != 0 && games[i].id != id) {
+			continue
+		}
+		if j := games[i].nickindex(args[0]); j >= 0 {
+			g, name = games[i], playername(games[i].who[j].user)
+		}
+	}
+	if g == nil {
+		sayusage(where, who, fmt.Sprintf("%s isn't in a recent game", args[0]))
+		return false
+	}
+	count, err := countnoshows(noshowsfile, name, g.id)
+	if err != nil {
+		log.Println(err)
+	}
+	if count < 0 {
+		sayusage(where, who, fmt.Sprintf("%s's no-show in #%d is already recorded", name, g.id))
+		return false
+	}
+	if err := appendnoshow(noshowsfile, name, g); err != nil {
+		log.Println(err)
+	}
+	count++
+	s := csprintf("{orange}%s{r} didn't show for {orange}{b}%s{b} #%d{r} (%d in %d days)",
+		name, g.name, g.id, count, int(noshowperiod.Hours()/24))
+	if count >= noshowlimit {
+		d := noshowban * time.Duration(count-noshowlimit+1)
+		addban(Ban{mask: name, expire: time.Now().Add(d), reason: "repeated no-shows"})
+		s += csprintf(" and is banned from pickups for {b}%v{b}", d)
+	}
+	irc.privmsg(channel, s)
+	return true
+}
+
+func appendnoshow(fname, name string, g *Game) error {
+	f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%s\t%s\t%s\t%d\n", time.Now().Format(tlayout), name, g.name, g.id)
+	return err
+}
+
+// The number of no-shows recorded against name in noshowperiod, or -1
+// if one is already recorded for game id.
+func countnoshows(fname, name string, id int) (int, error) {
+	f, err := os.OpenFile(fname, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n := 0
+	r := bufio.NewScanner(f)
+	for r.Scan() {
+		ss := strings.Split(r.Text(), "\t")
+		if len(ss) != 4 || !strings.EqualFold(ss[1], name) {
+			continue
+		}
+		if ss[3] == strconv.Itoa(id) {
+			return -1, nil
+		}
+		t, err := time.ParseInLocation(tlayout, ss[0], time.Local)
+		if err == nil && time.Since(t) <= noshowperiod {
+			n++
+		}
+	}
+	return n, r.Err()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// No-shows are counted case-insensitively over noshowperiod, and only
+// once per game.
+func TestCountnoshows(t *testing.T) {
+	t.Chdir(t.TempDir())
+	now := time.Now()
+	old := now.Add(-noshowperiod - time.Hour).Format(tlayout)
+	lines := old + "\talice\tctf\t1\n" +
+		now.Add(-time.Hour).Format(tlayout) + "\tAlice\tctf\t7\n" +
+		now.Format(tlayout) + "\talice\tduel\t9\n" +
+		now.Format(tlayout) + "\tbob\tctf\t9\n" +
+		"bad line\n"
+	if err := os.WriteFile(noshowsfile, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name string
+		id   int
+		want int
+	}{
+		{"ALICE", 10, 2},
+		{"alice", 9, -1},
+		{"bob", 10, 1},
+		{"carol", 10, 0},
+	} {
+		n, err := countnoshows(noshowsfile, c.name, c.id)
+		if err != nil || n != c.want {
+			t.Errorf("%s in #%d: %d, %v; want %d", c.name, c.id, n, err, c.want)
+		}
+	}
+}
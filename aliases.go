@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Players' other names, so that games played as "nick|away" or
+// "nick_afk" count as nick's.
+const aliasfile = "pickupaliases.log"
+
+var aliases = make(map[string]string) // Main name by lower-cased alt.
+
+// The name name's games count under.
+func mainname(name string) string {
+	if m, ok := aliases[strings.ToLower(name)]; ok {
+		return m
+	}
+	return name
+}
+
+// The alts of the main name, sorted.
+func altsof(name string) []string {
+	var alts []string
+	for k, m := range aliases {
+		if strings.EqualFold(m, name) {
+			alts = append(alts, k)
+		}
+	}
+	sort.Strings(alts)
+	return alts
+}
+
+// Count alt as main, along with any alts alt had itself.
+func addalias(main, alt string) error {
+	main = mainname(main)
+	if strings.EqualFold(main, alt) {
+		return errors.New("those are the same player")
+	}
+	for _, a := range altsof(alt) {
+		aliases[a] = main
+	}
+	aliases[strings.ToLower(alt)] = main
+	return nil
+}
+
+// Has alt been seen logged in to account, now or in a past game?
+func hasaccount(alt, account string) bool {
+	if account == "" {
+		return false
+	}
+	if irc.account(alt) == account {
+		return true
+	}
+	for _, h := range hist.bynick[strings.ToLower(alt)] {
+		if hist.recs[h].account == account {
+			return true
+		}
+	}
+	return false
+}
+
+func alias(where, who string, args ...string) bool {
+	usage := "usage: !alias add [main] alt | !alias del alt | !alias list [nick] | !alias merge"
+	if len(args) < 1 {
+		sayusage(where, who, usage)
+		return false
+	}
+	op := initial || irc.isopped(who, channel)
+	switch strings.ToLower(args[0]) {
+	case "add":
+		var main, alt string
+		switch {
+		case len(args) == 3 && op:
+			main, alt = strings.Trim(args[1], "`^_"), strings.Trim(args[2], "`^_")
+		case len(args) == 2:
+			// Players may claim names they have been identified as.
+			main, alt = playername(who), strings.Trim(args[1], "`^_")
+			account := irc.account(who)
+			if account == "" {
+				sayusage(where, who, "identify with services to link your other names")
+				return false
+			}
+			if !op && !hasaccount(alt, account) {
+				sayusage(where, who, fmt.Sprintf("%s hasn't been identified as %s", alt, account))
+				return false
+			}
+			if m, ok := aliases[strings.ToLower(alt)]; ok && !op && !strings.EqualFold(m, mainname(main)) {
+				sayusage(where, who, fmt.Sprintf("%s is already an alias of %s", alt, m))
+				return false
+			}
+		default:
+			sayusage(where, who, usage)
+			return false
+		}
+		if err := addalias(main, alt); err != nil {
+			sayusage(where, who, err.Error())
+			return false
+		}
+		if err := writealiases(aliasfile); err != nil {
+			log.Println(err)
+		}
+		say(where, who, fmt.Sprintf("%s now counts as %s", alt, mainname(main)))
+	case "del":
+		if len(args) != 2 {
+			sayusage(where, who, usage)
+			return false
+		}
+		if !op {
+			sayusage(where, who, ErrPermission)
+			return false
+		}
+		k := strings.ToLower(strings.Trim(args[1], "`^_"))
+		if _, ok := aliases[k]; !ok {
+			sayusage(where, who, fmt.Sprintf("%s isn't an alias", args[1]))
+			return false
+		}
+		delete(aliases, k)
+		if err := writealiases(aliasfile); err != nil {
+			log.Println(err)
+		}
+		say(where, who, fmt.Sprintf("%s counts as itself again", args[1]))
+	case "list":
+		if len(args) > 2 {
+			sayusage(where, who, usage)
+			return false
+		}
+		name := playername(who)
+		if len(args) == 2 {
+			name = strings.Trim(args[1], "`^_")
+		}
+		main := mainname(name)
+		alts := altsof(main)
+		if len(alts) == 0 {
+			say(where, who, fmt.Sprintf("%s has no aliases", main))
+			return true
+		}
+		say(where, who, csprintf("{orange}{b}%s{b}{r}: %s", main, strings.Join(alts, " ")))
+	case "merge":
+		if len(args) != 1 {
+			sayusage(where, who, usage)
+			return false
+		}
+		if !op {
+			sayusage(where, who, ErrPermission)
+			return false
+		}
+		n, err := hist.rename(mainname)
+		if err != nil {
+			log.Println(err)
+			sayusage(where, who, "the history could not be rewritten")
+			return false
+		}
+		say(where, who, fmt.Sprintf("renamed %d history entries", n))
+	default:
+		sayusage(where, who, usage)
+		return false
+	}
+	return true
+}
+
+func readaliases(fname string) error {
+	f, err := os.OpenFile(fname, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewScanner(f)
+	for r.Scan() {
+		ss := strings.Split(r.Text(), "\t")
+		if len(ss) != 2 {
+			log.Println("bad entry in aliases")
+			continue
+		}
+		aliases[strings.ToLower(ss[0])] = ss[1]
+	}
+	return r.Err()
+}
+
+func writealiases(fname string) error {
+	return writeatomic(fname, func(w *bufio.Writer) error {
+		for k, m := range aliases {
+			fmt.Fprintf(w, "%s\t%s\n", k, m)
+		}
+		return nil
+	})
+}
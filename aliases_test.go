@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// An alias's games count as its main name's, including those of its
+// own aliases, until the history is merged under the main names.
+func TestAliases(t *testing.T) {
+	testbot(t)
+	now := time.Now()
+	err := hist.add([]HistVal{
+		{v: histversion, t: now.Add(-time.Hour), mode: "ctf", nick: "alice", id: 1},
+		{v: histversion, t: now.Add(-time.Hour), mode: "ctf", nick: "bob", id: 1},
+		{v: histversion, t: now, mode: "ctf", nick: "alice|away", id: 2},
+		{v: histversion, t: now, mode: "ctf", nick: "Ali", id: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := addalias("ali", "alice|away"); err != nil {
+		t.Fatal(err)
+	}
+	if err := addalias("alice", "ali"); err != nil {
+		t.Fatal(err)
+	}
+	if err := addalias("alice|away", "alice"); err == nil {
+		t.Error("aliased alice to herself")
+	}
+	if m := mainname("ALICE|AWAY"); m != "alice" {
+		t.Errorf("alice|away counts as %s", m)
+	}
+	if hs := hist.player("Ali"); len(hs) != 3 {
+		t.Errorf("alice has %d entries", len(hs))
+	}
+	if err := writealiases(aliasfile); err != nil {
+		t.Fatal(err)
+	}
+	aliases = make(map[string]string)
+	if err := readaliases(aliasfile); err != nil {
+		t.Fatal(err)
+	}
+	if alts := altsof("alice"); strings.Join(alts, " ") != "ali alice|away" {
+		t.Errorf("alice's aliases %v", alts)
+	}
+	n, err := hist.rename(mainname)
+	if err != nil || n != 2 {
+		t.Errorf("renamed %d: %v", n, err)
+	}
+	aliases = make(map[string]string)
+	if hs := hist.player("alice"); len(hs) != 3 {
+		t.Errorf("alice has %d entries after merging", len(hs))
+	}
+}
+
+// Players can only claim names identified with their own account.
+func TestAliasAccount(t *testing.T) {
+	testbot(t)
+	if err := hist.add([]HistVal{{v: histversion, t: time.Now(), mode: "ctf", nick: "alt", account: "acc"}}); err != nil {
+		t.Fatal(err)
+	}
+	if !hasaccount("alt", "acc") || hasaccount("alt", "other") || hasaccount("alt", "") {
+		t.Error("wrong accounts for alt")
+	}
+	if alias("#pickup", "bob!u@h", "add", "alt") || len(aliases) != 0 {
+		t.Errorf("unidentified bob claimed alt: %v", aliases)
+	}
+}
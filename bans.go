@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A pickup ban, which stops matching players from !adding. The mask is
+// a services account as "$a:account", a hostmask as "nick!user@host",
+// or a nick, and may contain * and ? wildcards.
+type Ban struct {
+	mask   string
+	expire time.Time // When the ban lapses.
+	reason string
+	by     string // Nick of the op who set it, or "" if automatic.
+}
+
+const bansfile = "pickupbans.log"
+
+var bans []Ban
+
+// Case-insensitive match of s against pattern, where * matches any
+// run of characters and ? matches any one character.
+func wildmatch(pattern, s string) bool {
+	p, t := []rune(strings.ToLower(pattern)), []rune(strings.ToLower(s))
+	star, mark := -1, 0
+	i, j := 0, 0
+	for j < len(t) {
+		switch {
+		case i < len(p) && (p[i] == '?' || p[i] == t[j]):
+			i++
+			j++
+		case i < len(p) && p[i] == '*':
+			star, mark = i, j
+			i++
+		case star >= 0:
+			i = star + 1
+			mark++
+			j = mark
+		default:
+			return false
+		}
+	}
+	for i < len(p) && p[i] == '*' {
+		i++
+	}
+	return i == len(p)
+}
+
+func (b *Ban) matches(who string) bool {
+	switch {
+	case strings.HasPrefix(b.mask, "$a:"):
+		acct := irc.account(who)
+		return acct != "" && wildmatch(b.mask[3:], acct)
+	case strings.ContainsAny(b.mask, "!@"):
+		return wildmatch(b.mask, who)
+	}
+	nick, _, _ := splituserstring(who)
+	return wildmatch(b.mask, nick) || wildmatch(b.mask, playername(who))
+}
+
+// Durations like time.ParseDuration's, plus days (d) and weeks (w),
+// e.g. "1w2d12h".
+func parseduration(s string) (time.Duration, error) {
+	var d time.Duration
+	for {
+		i := strings.IndexAny(s, "dw")
+		if i < 0 {
+			break
+		}
+		n, err := strconv.Atoi(s[:i])
+		if err != nil {
+			return 0, errors.New("bad duration")
+		}
+		unit := 24 * time.Hour
+		if s[i] == 'w' {
+			unit *= 7
+		}
+		d += time.Duration(n) * unit
+		s = s[i+1:]
+	}
+	if s == "" {
+		return d, nil
+	}
+	dd, err := time.ParseDuration(s)
+	return d + dd, err
+}
+
+// Drop lapsed bans.
+func prunebans() {
+	now := time.Now()
+	for i := 0; i < len(bans); i++ {
+		if !now.Before(bans[i].expire) {
+			bans = append(bans[:i], bans[i+1:]...)
+			i--
+		}
+	}
+}
+
+// The ban that applies to who, if any.
+func findban(who string) *Ban {
+	prunebans()
+	for i := range bans {
+		if bans[i].matches(who) {
+			return &bans[i]
+		}
+	}
+	return nil
+}
+
+// Is who banned? If so, tell them for how long and why.
+func checkban(where, who string) bool {
+	b := findban(who)
+	if b != nil {
+		sayusage(where, who, fmt.Sprintf("you are banned from pickups for another %v: %s",
+			time.Until(b.expire).Round(time.Minute), b.reason))
+	}
+	return b != nil
+}
+
+// Add or replace the ban on b.mask and take matching players out of
+// every mode.
+func addban(b Ban) {
+	found := false
+	for i := range bans {
+		if strings.EqualFold(bans[i].mask, b.mask) {
+			bans[i], found = b, true
+		}
+	}
+	if !found {
+		bans = append(bans, b)
+	}
+	writebans(bansfile)
+	update := false
+	for _, m := range modes {
+		var users []string
+		for _, u := range m.who {
+			if b.matches(u.user) {
+				users = append(users, u.user)
+			}
+		}
+		for _, u := range users {
+			update = m.removeplayer(u) || update
+		}
+	}
+	if update {
+		updatetopic()
+	}
+}
+
+func readbans(fname string) error {
+	f, err := os.OpenFile(fname, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewScanner(f)
+	for r.Scan() {
+		ss := strings.SplitN(r.Text(), "\t", 4)
+		if len(ss) < 3 {
+			log.Println("bad entry in bans")
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, ss[1])
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		b := Ban{mask: ss[0], expire: t, reason: ss[len(ss)-1]}
+		if len(ss) == 4 {
+			b.by = ss[2]
+		}
+		bans = append(bans, b)
+	}
+	return r.Err()
+}
+
+func writebans(fname string) {
+	err := writeatomic(fname, func(w *bufio.Writer) error {
+		for _, b := range bans {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", b.mask, b.expire.Format(time.RFC3339), b.by, b.reason)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func pban(where, who string, args ...string) bool {
+	if len(args) < 3 {
+		sayusage(where, who, "usage: !pban nick|nick!user@host|$a:account duration|perm reason")
+		return false
+	}
+	expire := time.Now().AddDate(100, 0, 0)
+	if strings.ToLower(args[1]) != "perm" {
+		d, err := parseduration(args[1])
+		if err != nil || d <= 0 {
+			sayusage(where, who, "error: bad duration (e.g. 30m, 12h, 3d, 2w)")
+			return false
+		}
+		expire = time.Now().Add(d)
+	}
+	by, _, _ := splituserstring(who)
+	addban(Ban{args[0], expire, strings.Join(args[2:], " "), by})
+	say(where, who, fmt.Sprintf("banned %s until %s", args[0], expire.Format(tlayout)))
+	return true
+}
+
+func punban(where, who string, args ...string) bool {
+	if len(args) != 1 {
+		sayusage(where, who, "usage: !punban mask")
+		return false
+	}
+	for i := range bans {
+		if strings.EqualFold(bans[i].mask, args[0]) {
+			bans = append(bans[:i], bans[i+1:]...)
+			writebans(bansfile)
+			say(where, who, fmt.Sprintf("unbanned %s", args[0]))
+			return true
+		}
+	}
+	sayusage(where, who, fmt.Sprintf("%s: no such ban", args[0]))
+	return false
+}
+
+func listbans(where, who string, args ...string) bool {
+	prunebans()
+	if len(bans) == 0 {
+		say(where, who, "no bans")
+		return true
+	}
+	for _, b := range bans {
+		by := b.by
+		if by == "" {
+			by = "pkup"
+		}
+		say(where, who, fmt.Sprintf("%s until %s by %s: %s",
+			b.mask, b.expire.Format(tlayout), by, b.reason))
+		time.Sleep(60 * time.Millisecond)
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWildmatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"alice", "alice", true},
+		{"Alice", "aLICE", true},
+		{"alice", "alice2", false},
+		{"al?ce", "alice", true},
+		{"al?ce", "alce", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"a*", "alice", true},
+		{"*e", "alice", true},
+		{"*li*", "alice", true},
+		{"a*c*e", "alice", true},
+		{"a*c*e", "alicf", false},
+		{"*!*@*.example.com", "bob!~b@host.example.com", true},
+		{"*!*@*.example.com", "bob!~b@example.com", false},
+		{"a**b", "ab", true},
+		{"", "", true},
+		{"", "a", false},
+		{"ä*", "Älice", true},
+	} {
+		if got := wildmatch(c.pattern, c.s); got != c.want {
+			t.Errorf("wildmatch(%q, %q) = %t, want %t", c.pattern, c.s, got, c.want)
+		}
+	}
+}
+
+func TestParseduration(t *testing.T) {
+	const day = 24 * time.Hour
+	for _, c := range []struct {
+		s    string
+		want time.Duration
+		bad  bool
+	}{
+		{s: "90m", want: 90 * time.Minute},
+		{s: "2d", want: 2 * day},
+		{s: "1w", want: 7 * day},
+		{s: "1w2d12h", want: 9*day + 12*time.Hour},
+		{s: "3d30m", want: 3*day + 30*time.Minute},
+		{s: "d", bad: true},
+		{s: "1x", bad: true},
+		{s: "1.5d", bad: true},
+	} {
+		d, err := parseduration(c.s)
+		switch {
+		case c.bad && err == nil:
+			t.Errorf("%q: parsed as %v", c.s, d)
+		case !c.bad && (err != nil || d != c.want):
+			t.Errorf("%q: %v, %v; want %v", c.s, d, err, c.want)
+		}
+	}
+}
+
+func TestBanMatches(t *testing.T) {
+	testbot(t)
+	for _, c := range []struct {
+		mask, who string
+		want      bool
+	}{
+		{"alice", "alice!a@h", true},
+		{"alice", "alice_!a@h", true}, // Her player name.
+		{"alice", "alicia!a@h", false},
+		{"al*", "alicia!a@h", true},
+		{"*!*@bad.host", "carol!c@bad.host", true},
+		{"*!*@bad.host", "carol!c@good.host", false},
+		{"$a:alice", "alice!a@h", false}, // Not logged in.
+	} {
+		b := Ban{mask: c.mask}
+		if got := b.matches(c.who); got != c.want {
+			t.Errorf("%q matches %q: %t, want %t", c.mask, c.who, got, c.want)
+		}
+	}
+}
+
+func TestCheckban(t *testing.T) {
+	testbot(t)
+	saved := bans
+	t.Cleanup(func() { bans = saved })
+	bans = []Ban{{mask: "alice", expire: time.Now().Add(time.Hour), reason: "no-shows"}}
+	if checkban("#pickup", "bob!b@h") || len(irc.out) != 0 {
+		t.Error("bob is banned")
+	}
+	if !checkban("#pickup", "alice!a@h") {
+		t.Fatal("alice isn't banned")
+	}
+	if s := <-irc.out; !strings.HasPrefix(s, "NOTICE alice ") || !strings.Contains(s, "1h0m0s: no-shows") {
+		t.Errorf("told %q", s)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The operator settings, saved whole after every change so that
+// restarting rebuilds exactly what was running.
+type Config struct {
+	Motd      string         `json:"motd,omitempty"`
+	Mumble    string         `json:"mumble,omitempty"`
+	Teamspeak string         `json:"teamspeak,omitempty"`
+	Voip      string         `json:"voip,omitempty"`
+	Reminders []string       `json:"reminders"` // Lead times of scheduled pickup reminders.
+	Modes     []ModeConfig   `json:"modes"`
+	Servers   []ServerConfig `json:"servers"`
+}
+
+type ModeConfig struct {
+	Name      string   `json:"name"`
+	Players   int      `json:"players"`
+	Teams     int      `json:"teams,omitempty"`
+	Size      int      `json:"size,omitempty"`
+	Names     []string `json:"names,omitempty"`
+	Pick      string   `json:"pick,omitempty"`
+	Order     string   `json:"order,omitempty"`
+	Expire    string   `json:"expire,omitempty"`
+	MaxExpire string   `json:"maxexpire,omitempty"`
+	Priority  int      `json:"priority,omitempty"`
+	Promote   int      `json:"promote,omitempty"`
+	Maps      []string `json:"maps,omitempty"`
+}
+
+type ServerConfig struct {
+	Alias    string   `json:"alias"`
+	Game     string   `json:"game"`
+	Host     string   `json:"host"` // host:port
+	Password string   `json:"password,omitempty"`
+	Modes    []string `json:"modes"`
+}
+
+const configfile = "pickup.json"
+
+// The running settings as a Config.
+func currentconfig() *Config {
+	c := &Config{Motd: motd, Mumble: mumble, Teamspeak: teamspeak, Voip: voip, Reminders: []string{}}
+	for _, d := range reminders {
+		c.Reminders = append(c.Reminders, d.String())
+	}
+	srvs := make(map[string]*ServerConfig)
+	ks := make([]string, 0, len(modes))
+	for k := range modes {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	for _, k := range ks {
+		m := modes[k]
+		mc := ModeConfig{
+			Name:     m.name,
+			Players:  m.nneeded,
+			Teams:    m.teams,
+			Size:     m.teamsize,
+			Names:    m.teamnames,
+			Pick:     m.pickmethod,
+			Order:    m.pickorder,
+			Priority: m.priority,
+			Promote:  m.promoteat,
+			Maps:     m.maps,
+		}
+		if m.expire > 0 {
+			mc.Expire = m.expire.String()
+		}
+		if m.maxexpire > 0 {
+			mc.MaxExpire = m.maxexpire.String()
+		}
+		c.Modes = append(c.Modes, mc)
+		for _, srv := range m.srvs {
+			sc := &ServerConfig{Alias: srv.alias(), Game: srv.kind(), Host: srv.addr(), Password: srv.password()}
+			if old, ok := srvs[sc.key()]; ok {
+				sc = old
+			} else {
+				srvs[sc.key()] = sc
+			}
+			sc.Modes = append(sc.Modes, m.name)
+		}
+	}
+	sort.Slice(c.Modes, func(i, j int) bool {
+		return strings.ToLower(c.Modes[i].Name) < strings.ToLower(c.Modes[j].Name)
+	})
+	for _, sc := range srvs {
+		sort.Strings(sc.Modes)
+		c.Servers = append(c.Servers, *sc)
+	}
+	sort.Slice(c.Servers, func(i, j int) bool {
+		return c.Servers[i].key() < c.Servers[j].key()
+	})
+	return c
+}
+
+// Servers with the same alias may be different hosts, or even games, in
+// different modes, so they are told apart by all three.
+func (sc *ServerConfig) key() string {
+	return strings.ToLower(sc.Alias) + "\t" + strings.ToLower(sc.Game) + "\t" + strings.ToLower(sc.Host)
+}
+
+// The modes c describes, with their servers.
+func (c *Config) modes() (map[string]*Mode, error) {
+	ms := make(map[string]*Mode, len(c.Modes))
+	for _, mc := range c.Modes {
+		k := strings.ToLower(mc.Name)
+		if mc.Name == "" || strings.ContainsAny(mc.Name, " \t") {
+			return nil, fmt.Errorf("bad mode name %q", mc.Name)
+		}
+		if _, ok := ms[k]; ok {
+			return nil, fmt.Errorf("%s: mode defined twice", mc.Name)
+		}
+		m := &Mode{name: mc.Name, nneeded: mc.Players, maps: mc.Maps}
+		attrs := [][2]string{
+			{"teams", strconv.Itoa(mc.Teams)},
+			{"size", strconv.Itoa(mc.Size)},
+			{"priority", strconv.Itoa(mc.Priority)},
+			{"promote", strconv.Itoa(mc.Promote)},
+		}
+		if mc.Names != nil {
+			attrs = append(attrs, [2]string{"names", strings.Join(mc.Names, ",")})
+		}
+		if mc.Pick != "" {
+			attrs = append(attrs, [2]string{"pick", mc.Pick})
+		}
+		if mc.Order != "" {
+			attrs = append(attrs, [2]string{"order", mc.Order})
+		}
+		if mc.Expire != "" {
+			attrs = append(attrs, [2]string{"expire", mc.Expire})
+		}
+		if mc.MaxExpire != "" {
+			attrs = append(attrs, [2]string{"maxexpire", mc.MaxExpire})
+		}
+		for _, a := range attrs {
+			if err := m.setattr(a[0], a[1]); err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", mc.Name, a[0], err)
+			}
+		}
+		if m.teamsize > 0 {
+			m.nneeded = m.teamsize * m.nteams()
+		}
+		if m.nneeded < 1 {
+			return nil, fmt.Errorf("%s: needs at least one player", mc.Name)
+		}
+		ms[k] = m
+	}
+	for _, sc := range c.Servers {
+		for _, name := range sc.Modes {
+			m, ok := ms[strings.ToLower(name)]
+			if !ok {
+				return nil, fmt.Errorf("server %s: %s: no such mode", sc.Alias, name)
+			}
+			srv, err := newserver(sc.Game, sc.Alias, sc.Host, sc.Password)
+			if err != nil {
+				return nil, fmt.Errorf("server %s: %v", sc.Alias, err)
+			}
+			m.srvs = append(m.srvs, srv)
+		}
+	}
+	return ms, nil
+}
+
+// Put c into effect, replacing the modes but keeping their players.
+// Modes that are kept are updated in place, as games, ladders, cups
+// and the schedule hold on to them.
+func (c *Config) apply() error {
+	ms, err := c.modes()
+	if err != nil {
+		return err
+	}
+	var ds []time.Duration
+	for _, s := range c.Reminders {
+		d, err := parseduration(s)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("reminders: bad duration %q", s)
+		}
+		ds = append(ds, d)
+	}
+	for k, m := range ms {
+		if old, ok := modes[k]; ok {
+			m.who, m.srv, m.promoted = old.who, old.srv, old.promoted
+			*old = *m
+			ms[k] = old
+		}
+	}
+	modes = ms
+	motd, mumble, teamspeak, voip = c.Motd, c.Mumble, c.Teamspeak, c.Voip
+	if c.Reminders != nil {
+		putreminders(ds)
+	}
+	return nil
+}
+
+func readconfig(fname string) (*Config, error) {
+	b, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	c := new(Config)
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+	return c, nil
+}
+
+// Rewrite the config file from the running settings.
+func writeconfig(fname string) {
+	b, err := json.MarshalIndent(currentconfig(), "", "\t")
+	if err == nil {
+		err = writeatomic(fname, func(w *bufio.Writer) error {
+			_, err := w.Write(append(b, '\n'))
+			return err
+		})
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Load the config file, or if there isn't one yet, build it from the
+// operator commands in the old rc file and set that aside.
+func loadconfig(fname, rcname string) error {
+	c, err := readconfig(fname)
+	if err == nil {
+		return c.apply()
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if _, err := os.Stat(rcname); err == nil {
+		log.Printf("migrating %s to %s\n", rcname, fname)
+		if err := execrc(rcname); err != nil {
+			return err
+		}
+		writeconfig(fname)
+		return os.Rename(rcname, rcname+".old")
+	}
+	writeconfig(fname)
+	return nil
+}
+
+// Re-read the config file and put it into effect, keeping the players of
+// modes that still exist, and describe what changed.
+func reloadconfig() ([]string, error) {
+	c, err := readconfig(configfile)
+	if err != nil {
+		return nil, err
+	}
+	old := currentconfig()
+	oldmodes := modes
+	if err := c.apply(); err != nil {
+		return nil, err
+	}
+	changes := diffconfig(old, currentconfig())
+	for k, m := range oldmodes {
+		if _, ok := modes[k]; !ok && len(m.who) > 0 {
+			changes = append(changes, fmt.Sprintf("removed %d players from %s", len(m.who), m.name))
+		}
+	}
+	return changes, nil
+}
+
+// What differs between a and b, one change per string.
+func diffconfig(a, b *Config) []string {
+	var ss []string
+	am := make(map[string]ModeConfig)
+	for _, mc := range a.Modes {
+		am[strings.ToLower(mc.Name)] = mc
+	}
+	bm := make(map[string]bool)
+	for _, mc := range b.Modes {
+		k := strings.ToLower(mc.Name)
+		bm[k] = true
+		old, ok := am[k]
+		switch {
+		case !ok:
+			ss = append(ss, "added mode "+mc.Name)
+		case !reflect.DeepEqual(old, mc):
+			ss = append(ss, "changed mode "+mc.Name)
+		}
+	}
+	for _, mc := range a.Modes {
+		if !bm[strings.ToLower(mc.Name)] {
+			ss = append(ss, "removed mode "+mc.Name)
+		}
+	}
+	as := make(map[string]ServerConfig)
+	for _, sc := range a.Servers {
+		as[sc.key()] = sc
+	}
+	bs := make(map[string]bool)
+	for _, sc := range b.Servers {
+		bs[sc.key()] = true
+		old, ok := as[sc.key()]
+		switch {
+		case !ok:
+			ss = append(ss, "added server "+sc.Alias+" ("+sc.Host+")")
+		case !reflect.DeepEqual(old, sc):
+			ss = append(ss, "changed server "+sc.Alias+" ("+sc.Host+")")
+		}
+	}
+	for _, sc := range a.Servers {
+		if !bs[sc.key()] {
+			ss = append(ss, "removed server "+sc.Alias+" ("+sc.Host+")")
+		}
+	}
+	for _, f := range []struct{ name, a, b string }{
+		{"motd", a.Motd, b.Motd},
+		{"mumble", a.Mumble, b.Mumble},
+		{"teamspeak", a.Teamspeak, b.Teamspeak},
+		{"voip", a.Voip, b.Voip},
+		{"reminders", strings.Join(a.Reminders, " "), strings.Join(b.Reminders, " ")},
+	} {
+		if f.a != f.b {
+			ss = append(ss, "changed "+f.name)
+		}
+	}
+	return ss
+}
+
+func reload(where, who string, args ...string) bool {
+	changes, err := reloadconfig()
+	if err != nil {
+		sayusage(where, who, fmt.Sprintf("%s not reloaded: %v", configfile, err))
+		return false
+	}
+	if len(changes) == 0 {
+		say(where, who, "reloaded "+configfile+": no changes")
+	} else {
+		say(where, who, "reloaded "+configfile+": "+strings.Join(changes, ", "))
+	}
+	updatetopic()
+	startfull()
+	return true
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Reloading updates the modes that games and cups point to, rather than
+// leaving them on copies that are no longer used.
+func TestApply(t *testing.T) {
+	testbot(t)
+	c := &Config{Modes: []ModeConfig{{Name: "ctf", Players: 8}, {Name: "duel", Players: 2}}}
+	if err := c.apply(); err != nil {
+		t.Fatal(err)
+	}
+	ctf := modes["ctf"]
+	ctf.addplayer("a!u@h", time.Now())
+	g := newgame(ctf, nil)
+	c.Modes = []ModeConfig{{Name: "CTF", Players: 10, Priority: 2}}
+	if err := c.apply(); err != nil {
+		t.Fatal(err)
+	}
+	if modes["ctf"] != ctf || g.mode != ctf {
+		t.Fatal("ctf was replaced")
+	}
+	if ctf.name != "CTF" || ctf.nneeded != 10 || ctf.priority != 2 || len(ctf.who) != 1 {
+		t.Errorf("ctf is %+v", ctf)
+	}
+	if _, ok := modes["duel"]; ok {
+		t.Error("duel wasn't removed")
+	}
+}
+
+func TestDiffconfig(t *testing.T) {
+	base := func() *Config {
+		return &Config{
+			Motd:      "hi",
+			Reminders: []string{"1h"},
+			Modes:     []ModeConfig{{Name: "ctf", Players: 8}, {Name: "duel", Players: 2}},
+			Servers:   []ServerConfig{{Alias: "one", Game: "quake", Host: "1.2.3.4", Modes: []string{"ctf"}}},
+		}
+	}
+	for _, c := range []struct {
+		edit func(*Config)
+		want string
+	}{
+		{func(*Config) {}, ""},
+		{func(c *Config) { c.Modes[0], c.Modes[1] = c.Modes[1], c.Modes[0] }, ""},
+		{func(c *Config) { c.Modes[0].Players = 10 }, "changed mode ctf"},
+		{func(c *Config) { c.Modes[1].Maps = []string{"q3dm17"} }, "changed mode duel"},
+		{func(c *Config) { c.Modes = append(c.Modes, ModeConfig{Name: "tdm", Players: 8}) }, "added mode tdm"},
+		{func(c *Config) { c.Modes = c.Modes[:1] }, "removed mode duel"},
+		{func(c *Config) { c.Servers[0].Modes = []string{"ctf", "duel"} }, "changed server one (1.2.3.4)"},
+		{func(c *Config) { c.Servers[0].Alias = "ONE" }, "changed server ONE (1.2.3.4)"},
+		{func(c *Config) { c.Servers = nil }, "removed server one (1.2.3.4)"},
+		{func(c *Config) { c.Servers[0].Host = "5.6.7.8" }, "added server one (5.6.7.8), removed server one (1.2.3.4)"},
+		{func(c *Config) { c.Motd, c.Voip = "", "voip" }, "changed motd, changed voip"},
+		{func(c *Config) { c.Reminders = []string{"1h", "10m"} }, "changed reminders"},
+		{func(c *Config) { c.Modes = c.Modes[1:]; c.Servers = nil }, "removed mode ctf, removed server one (1.2.3.4)"},
+	} {
+		b := base()
+		c.edit(b)
+		if got := strings.Join(diffconfig(base(), b), ", "); got != c.want {
+			t.Errorf("got %q, want %q", got, c.want)
+		}
+	}
+}
+
+// Modes whose servers share an alias but not a host keep both hosts.
+func TestCurrentconfig(t *testing.T) {
+	testbot(t)
+	c := &Config{
+		Modes: []ModeConfig{{Name: "ctf", Players: 8}, {Name: "duel", Players: 2}, {Name: "tdm", Players: 8}},
+		Servers: []ServerConfig{
+			{Alias: "eu", Game: "quake", Host: "5.6.7.8:27960", Modes: []string{"duel"}},
+			{Alias: "eu", Game: "quake", Host: "1.2.3.4:27960", Modes: []string{"ctf", "tdm"}},
+		},
+	}
+	if err := c.apply(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		got := currentconfig()
+		if len(got.Servers) != 2 {
+			t.Fatalf("got servers %+v", got.Servers)
+		}
+		if a, b := got.Servers[0], got.Servers[1]; a.Host != "1.2.3.4:27960" || strings.Join(a.Modes, " ") != "ctf tdm" ||
+			b.Host != "5.6.7.8:27960" || strings.Join(b.Modes, " ") != "duel" {
+			t.Fatalf("got servers %+v", got.Servers)
+		}
+	}
+}
+
+func TestReloadconfig(t *testing.T) {
+	testbot(t)
+	c := &Config{Modes: []ModeConfig{{Name: "ctf", Players: 8}, {Name: "duel", Players: 2}}}
+	if err := c.apply(); err != nil {
+		t.Fatal(err)
+	}
+	modes["duel"].addplayer("a!u@h", time.Now())
+	if _, err := reloadconfig(); err == nil {
+		t.Error("reloaded a missing file")
+	}
+	os.WriteFile(configfile, []byte(`{"modes": [{"name": "ctf", "players": 10}]}`), 0644)
+	changes, err := reloadconfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(changes, ", "); got != "changed mode ctf, removed mode duel, removed 1 players from duel" {
+		t.Errorf("changes: %s", got)
+	}
+	os.WriteFile(configfile, []byte(`{"modes": [{"name": "ctf", "players": 0}]}`), 0644)
+	if _, err := reloadconfig(); err == nil || modes["ctf"].nneeded != 10 {
+		t.Errorf("bad config: %v, ctf needs %d", err, modes["ctf"].nneeded)
+	}
+}
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"log"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A knockout tournament of two-player matches in a mode.
+type Cup struct {
+	name      string
+	mode      *Mode
+	size      int      // Bracket size, a power of two.
+	double    bool     // Double elimination?
+	seeding   string   // "rating" or "random".
+	who       []string // Entrants, in seed order once started.
+	matches   []*Match // In the order they can be played.
+	started   bool
+	cancelled bool
+	champion  string // Winner once the cup is over.
+}
+
+// A place in a match, filled by an entrant or by the winner or loser of
+// an earlier match.
+type Slot struct {
+	from  *Match // Match that fills the slot, or nil for an entrant.
+	loser bool   // Filled by from's loser rather than its winner?
+	user  string // Player, or "" for a bye.
+	done  bool   // Filled yet?
+}
+
+type Match struct {
+	cup    *Cup
+	num    int
+	round  string // "W1", "L1", "GF" and so on.
+	slots  [2]Slot
+	winner int   // Winning slot, 1 or 2, once played.
+	game   *Game // Game being played, if any.
+	held   bool  // Aborted, and waiting to be replayed or awarded.
+}
+
+const maxcupsize = 64
+
+var (
+	cups     []*Cup
+	cupnames = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+func findcup(name string) *Cup {
+	for _, c := range cups {
+		if strings.EqualFold(c.name, name) {
+			return c
+		}
+	}
+	return nil
+}
+
+// The named cup or, if name is "", the only cup still running or the
+// last cup if none are.
+func pickcup(name string) *Cup {
+	if name != "" {
+		return findcup(name)
+	}
+	var c *Cup
+	for _, cc := range cups {
+		if cc.champion == "" {
+			if c != nil {
+				return nil
+			}
+			c = cc
+		}
+	}
+	if c == nil && len(cups) > 0 {
+		c = cups[len(cups)-1]
+	}
+	return c
+}
+
+// Bracket positions of seeds 1 to n, so that the top seeds meet last.
+func seedorder(n int) []int {
+	order := []int{1}
+	for len(order) < n {
+		next := make([]int, 0, 2*len(order))
+		for _, s := range order {
+			next = append(next, s, 2*len(order)+1-s)
+		}
+		order = next
+	}
+	return order
+}
+
+func (c *Cup) newmatch(round string, a, b Slot) *Match {
+	m := &Match{cup: c, num: len(c.matches) + 1, round: round, slots: [2]Slot{a, b}}
+	c.matches = append(c.matches, m)
+	return m
+}
+
+func winnerof(m *Match) Slot { return Slot{from: m} }
+func loserof(m *Match) Slot  { return Slot{from: m, loser: true} }
+
+// Put the entrants in seed order.
+func (c *Cup) seed() {
+	if c.seeding == "rating" {
+		sort.SliceStable(c.who, func(i, j int) bool {
+			return rating(c.mode.name, playername(c.who[i])) > rating(c.mode.name, playername(c.who[j]))
+		})
+	} else {
+		rand.Shuffle(len(c.who), func(i, j int) { c.who[i], c.who[j] = c.who[j], c.who[i] })
+	}
+}
+
+// Lay out the bracket for the seeded entrants. The same entrants always
+// give the same bracket.
+func (c *Cup) build() {
+	entrant := func(seed int) Slot {
+		if seed <= len(c.who) {
+			return Slot{user: c.who[seed-1], done: true}
+		}
+		return Slot{done: true} // A bye.
+	}
+	order := seedorder(c.size)
+	var round []*Match
+	for i := 0; i < len(order); i += 2 {
+		round = append(round, c.newmatch("W1", entrant(order[i]), entrant(order[i+1])))
+	}
+	wrounds := [][]*Match{round}
+	for r := 2; len(round) > 1; r++ {
+		var next []*Match
+		for i := 0; i < len(round); i += 2 {
+			next = append(next, c.newmatch(fmt.Sprintf("W%d", r), winnerof(round[i]), winnerof(round[i+1])))
+		}
+		round = next
+		wrounds = append(wrounds, round)
+	}
+	if !c.double {
+		return
+	}
+	// The losers' bracket: first the first round's losers play each
+	// other, then each later winners' round's losers drop in to play
+	// the survivors, who then play each other if there are enough.
+	var lround []*Match
+	l := 1
+	for i := 0; i < len(wrounds[0]); i += 2 {
+		lround = append(lround, c.newmatch("L1", loserof(wrounds[0][i]), loserof(wrounds[0][i+1])))
+	}
+	for r := 1; r < len(wrounds); r++ {
+		drops := wrounds[r]
+		l++
+		var next []*Match
+		for i := range lround {
+			d := drops[i]
+			if r%2 == 1 {
+				d = drops[len(drops)-1-i] // Avoid early rematches.
+			}
+			next = append(next, c.newmatch(fmt.Sprintf("L%d", l), winnerof(lround[i]), loserof(d)))
+		}
+		lround = next
+		if len(lround) > 1 {
+			l++
+			next = nil
+			for i := 0; i < len(lround); i += 2 {
+				next = append(next, c.newmatch(fmt.Sprintf("L%d", l), winnerof(lround[i]), winnerof(lround[i+1])))
+			}
+			lround = next
+		}
+	}
+	gf := c.newmatch("GF", winnerof(round[0]), winnerof(lround[0]))
+	// The bracket reset, played only if the winners' bracket player
+	// loses the grand final; otherwise its loser's slot is a bye.
+	c.newmatch("GF2", winnerof(gf), loserof(gf))
+}
+
+// The player in slot i (counting from 1), or "" for a bye.
+func (m *Match) player(i int) string {
+	return m.slots[i-1].user
+}
+
+// Fill slots from played matches, pass byes through and start any
+// match that is ready, until nothing changes; then see if the cup is
+// over.
+func (c *Cup) advance() {
+	if c.cancelled {
+		return
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, m := range c.matches {
+			if m.winner != 0 {
+				continue
+			}
+			for i := range m.slots {
+				s := &m.slots[i]
+				if s.done || s.from.winner == 0 {
+					continue
+				}
+				w := s.from.winner
+				if s.loser {
+					w = 3 - w
+				}
+				s.user, s.done, changed = s.from.player(w), true, true
+				if m.round == "GF2" && s.loser && s.from.winner == 1 {
+					s.user = "" // No reset needed.
+				}
+			}
+			if !m.slots[0].done || !m.slots[1].done {
+				continue
+			}
+			switch {
+			case m.slots[1].user == "":
+				m.winner, changed = 1, true
+			case m.slots[0].user == "":
+				m.winner, changed = 2, true
+			case m.game == nil && !m.held:
+				m.start()
+			}
+		}
+	}
+	final := c.matches[len(c.matches)-1]
+	if final.winner != 0 && c.champion == "" {
+		c.champion = final.player(final.winner)
+		nick, _, _ := splituserstring(c.champion)
+		irc.privmsg(channel, csprintf("{orange}{b}%s{b}{r} wins the {orange}{b}%s{b}{r} cup!", nick, c.name))
+	}
+	c.export()
+}
+
+// Start a game for a match whose players are both known.
+func (m *Match) start() {
+	c := m.cup
+	m.held = false
+	c.mode.updateservers()
+	players := []Player{{user: m.player(1)}, {user: m.player(2)}}
+	g := newgame(c.mode, players)
+	g.cupmatch = m
+	g.teamnames = []string{c.mode.teamname(1), c.mode.teamname(2)}
+	g.setteams([][]Player{players[:1], players[1:]})
+	m.game = g
+	irc.privmsg(channel, csprintf("{orange}{b}%s{b}{r} cup, %s: %s",
+		c.name, roundname(m.round, c.double), m.String()))
+	g.start()
+}
+
+// Record the winner of a match, from a reported game or an award.
+func (m *Match) settle(winner int) {
+	m.winner = winner
+	m.cup.advance()
+}
+
+// The name of a round, e.g. "winners' round 2".
+func roundname(round string, double bool) string {
+	n, _ := strconv.Atoi(round[1:])
+	switch {
+	case round == "GF":
+		return "grand final"
+	case round == "GF2":
+		return "grand final reset"
+	case round[0] == 'L':
+		return fmt.Sprintf("losers' round %d", n)
+	case double:
+		return fmt.Sprintf("winners' round %d", n)
+	}
+	return fmt.Sprintf("round %d", n)
+}
+
+func (m *Match) String() string {
+	var ps [2]string
+	for i, s := range m.slots {
+		switch {
+		case !s.done:
+			ps[i] = "?"
+		case s.user == "":
+			ps[i] = "bye"
+		default:
+			ps[i], _, _ = splituserstring(s.user)
+		}
+	}
+	s := fmt.Sprintf("#%d %s vs %s", m.num, ps[0], ps[1])
+	switch {
+	case m.winner != 0:
+		s += " -> " + ps[m.winner-1]
+	case m.held:
+		s += " (on hold)"
+	}
+	return s
+}
+
+// The cup's matches, one line per round.
+func (c *Cup) lines() []string {
+	var ss []string
+	round := ""
+	for _, m := range c.matches {
+		if m.round != round {
+			round = m.round
+			ss = append(ss, roundname(round, c.double)+":")
+		}
+		ss[len(ss)-1] += " " + m.String() + ";"
+	}
+	for i := range ss {
+		ss[i] = strings.TrimSuffix(ss[i], ";")
+	}
+	return ss
+}
+
+func (c *Cup) String() string {
+	kind := "single"
+	if c.double {
+		kind = "double"
+	}
+	state := fmt.Sprintf("%d/%d joined", len(c.who), c.size)
+	switch {
+	case c.champion != "":
+		nick, _, _ := splituserstring(c.champion)
+		state = "won by " + nick
+	case c.started:
+		state = "in progress"
+	}
+	return fmt.Sprintf("%s: %s, %s elimination seeded by %s, %s",
+		c.name, c.mode.name, kind, c.seeding, state)
+}
+
+// Write the bracket to an HTML file.
+func (c *Cup) export() {
+	fname := "pickupcup-" + strings.ToLower(c.name) + ".html"
+	err := writeatomic(fname, func(w *bufio.Writer) error {
+		title := html.EscapeString(c.name + " cup")
+		fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>%s</title></head><body>\n", title)
+		fmt.Fprintf(w, "<h1>%s</h1>\n<p>%s, updated %s</p>\n", title,
+			html.EscapeString(c.String()), time.Now().Format(tlayout))
+		round := ""
+		for _, m := range c.matches {
+			if m.round != round {
+				if round != "" {
+					fmt.Fprintln(w, "</ul>")
+				}
+				round = m.round
+				fmt.Fprintf(w, "<h2>%s</h2>\n<ul>\n", html.EscapeString(roundname(round, c.double)))
+			}
+			fmt.Fprintf(w, "<li>%s</li>\n", html.EscapeString(m.String()))
+		}
+		if round != "" {
+			fmt.Fprintln(w, "</ul>")
+		}
+		fmt.Fprintln(w, "</body></html>")
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Lay out the bracket for whoever has joined and start the first
+// matches.
+func (c *Cup) start() {
+	c.size = 2
+	for c.size < len(c.who) {
+		c.size *= 2
+	}
+	if c.double && c.size < 4 {
+		c.size = 4
+	}
+	c.started = true
+	c.seed()
+	c.build()
+	irc.privmsg(channel, csprintf("{orange}{b}%s{b}{r} cup is starting with %d players", c.name, len(c.who)))
+	c.advance()
+}
+
+var cupusage = "usage: !cup create name mode size [single|double] [rating|random] | join [name] | leave [name] | " +
+	"start [name] | show [name] | list | report [id] win|loss | forfeit [name] | award name nick | " +
+	"replay name match | cancel name"
+
+func cup(where, who string, args ...string) bool {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	op := irc.isopped(who, channel)
+	sub, args := strings.ToLower(args[0]), args[1:]
+	name := ""
+	if len(args) > 0 {
+		name = args[0]
+	}
+	switch sub {
+	case "create", "award", "replay", "start", "cancel":
+		if !op {
+			sayusage(where, who, "only operators may "+sub+" cups")
+			return false
+		}
+	}
+	switch sub {
+	case "list":
+		if len(cups) == 0 {
+			say(where, who, "no cups")
+		}
+		for _, c := range cups {
+			say(where, who, c.String())
+			time.Sleep(60 * time.Millisecond)
+		}
+		return true
+	case "report":
+		return report(where, who, args...)
+	case "create":
+		return cupcreate(where, who, args...)
+	case "award":
+		return cupaward(where, who, args...)
+	case "replay":
+		return cupreplay(where, who, args...)
+	}
+	c := pickcup(name)
+	if c == nil {
+		sayusage(where, who, "no such cup")
+		return false
+	}
+	switch sub {
+	case "join":
+		if c.started {
+			sayusage(where, who, "the cup has already started")
+			return false
+		}
+		if checkban(where, who) {
+			return false
+		}
+		for _, u := range c.who {
+			if u == who {
+				sayusage(where, who, "you have already joined")
+				return false
+			}
+		}
+		c.who = append(c.who, who)
+		nick, _, _ := splituserstring(who)
+		irc.privmsg(channel, csprintf("{orange}%s{r} joins the {orange}{b}%s{b}{r} cup [%d/%d]",
+			nick, c.name, len(c.who), c.size))
+		if len(c.who) == c.size {
+			c.start()
+		}
+	case "leave":
+		if c.started {
+			sayusage(where, who, "the cup has already started")
+			return false
+		}
+		for i, u := range c.who {
+			if u == who {
+				c.who = append(c.who[:i], c.who[i+1:]...)
+				say(where, who, fmt.Sprintf("you have left the %s cup", c.name))
+				return true
+			}
+		}
+		sayusage(where, who, "you haven't joined")
+		return false
+	case "start":
+		if c.started || len(c.who) < 2 {
+			sayusage(where, who, "the cup has already started or has too few players")
+			return false
+		}
+		c.start()
+	case "forfeit":
+		nick, _, _ := splituserstring(who)
+		m, i := c.openmatch(nick)
+		if m == nil {
+			sayusage(where, who, "you have no match to forfeit")
+			return false
+		}
+		irc.privmsg(channel, csprintf("{orange}%s{r} forfeits {orange}{b}%s{b}{r} cup match #%d",
+			nick, c.name, m.num))
+		m.forfeit(3 - i)
+	case "show":
+		say(where, who, c.String())
+		for _, s := range c.lines() {
+			time.Sleep(60 * time.Millisecond)
+			say(where, who, s)
+		}
+	case "cancel":
+		for i := range cups {
+			if cups[i] == c {
+				cups = append(cups[:i], cups[i+1:]...)
+				break
+			}
+		}
+		c.cancelled = true
+		irc.privmsg(channel, csprintf("{orange}{b}%s{b}{r} cup has been cancelled", c.name))
+	default:
+		sayusage(where, who, cupusage)
+		return false
+	}
+	return true
+}
+
+func cupcreate(where, who string, args ...string) bool {
+	if len(args) < 3 || len(args) > 5 {
+		sayusage(where, who, cupusage)
+		return false
+	}
+	m := modes[strings.ToLower(args[1])]
+	size, err := strconv.Atoi(args[2])
+	switch {
+	case !cupnames.MatchString(args[0]):
+		sayusage(where, who, "cup names may only have letters, digits, - and _")
+		return false
+	case findcup(args[0]) != nil:
+		sayusage(where, who, fmt.Sprintf("%s: a cup of that name exists", args[0]))
+		return false
+	case m == nil:
+		sayusage(where, who, fmt.Sprintf("%s: no such mode", args[1]))
+		return false
+	case err != nil || size < 2 || size > maxcupsize || size&(size-1) != 0:
+		sayusage(where, who, fmt.Sprintf("error: size must be a power of two up to %d", maxcupsize))
+		return false
+	}
+	c := &Cup{name: args[0], mode: m, size: size, seeding: "rating"}
+	for _, a := range args[3:] {
+		switch strings.ToLower(a) {
+		case "single":
+			c.double = false
+		case "double":
+			c.double = true
+		case "rating", "random":
+			c.seeding = strings.ToLower(a)
+		default:
+			sayusage(where, who, cupusage)
+			return false
+		}
+	}
+	cups = append(cups, c)
+	irc.privmsg(channel, csprintf("{orange}{b}%s{b}{r} cup created for %d players; say {b}!cup join %s{b} to enter",
+		c.name, c.size, c.name))
+	return true
+}
+
+// The match of c that nick is due to play or playing, and their slot.
+func (c *Cup) openmatch(nick string) (*Match, int) {
+	for _, m := range c.matches {
+		if m.winner != 0 || !m.slots[0].done || !m.slots[1].done {
+			continue
+		}
+		for i := 1; i <= 2; i++ {
+			if n, _, _ := splituserstring(m.player(i)); m.player(i) != "" && strings.EqualFold(n, nick) {
+				return m, i
+			}
+		}
+	}
+	return nil, 0
+}
+
+// Give the match to slot winner without it being played out, ending its
+// game if it has one.
+func (m *Match) forfeit(winner int) {
+	if m.game != nil && m.game.state < Finished {
+		m.game.state = Finished
+	}
+	m.settle(winner)
+}
+
+// Give a match to a player, e.g. when the other didn't show.
+func cupaward(where, who string, args ...string) bool {
+	if len(args) != 2 {
+		sayusage(where, who, "usage: !cup award name nick")
+		return false
+	}
+	c := findcup(args[0])
+	if c == nil {
+		sayusage(where, who, "no such cup")
+		return false
+	}
+	m, i := c.openmatch(args[1])
+	if m == nil {
+		sayusage(where, who, fmt.Sprintf("%s has no match to be awarded", args[1]))
+		return false
+	}
+	nick, _, _ := splituserstring(m.player(i))
+	irc.privmsg(channel, csprintf("{orange}{b}%s{b}{r} cup match #%d is awarded to {orange}%s",
+		c.name, m.num, nick))
+	m.forfeit(i)
+	return true
+}
+
+// Start an aborted match again.
+func cupreplay(where, who string, args ...string) bool {
+	if len(args) != 2 {
+		sayusage(where, who, "usage: !cup replay name match")
+		return false
+	}
+	c := findcup(args[0])
+	if c == nil {
+		sayusage(where, who, "no such cup")
+		return false
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(args[1], "#"))
+	if err != nil || n < 1 || n > len(c.matches) || !c.matches[n-1].held {
+		sayusage(where, who, fmt.Sprintf("%s: no such match on hold", args[1]))
+		return false
+	}
+	c.matches[n-1].start()
+	return true
+}
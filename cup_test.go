@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSeedorder(t *testing.T) {
+	for n, want := range map[int][]int{
+		1: {1},
+		2: {1, 2},
+		4: {1, 4, 2, 3},
+		8: {1, 8, 4, 5, 2, 7, 3, 6},
+	} {
+		if got := seedorder(n); !reflect.DeepEqual(got, want) {
+			t.Errorf("seedorder(%d) = %v, want %v", n, got, want)
+		}
+	}
+}
+
+// A cup of n players, seeded in join order, p1 first.
+func testcup(n int, double bool) *Cup {
+	m := &Mode{name: "duel", nneeded: 2}
+	modes["duel"] = m
+	c := &Cup{name: "test", mode: m, double: double, seeding: "random"}
+	for i := 1; i <= n; i++ {
+		c.who = append(c.who, fmt.Sprintf("p%d!u@h", i))
+	}
+	c.size = 2
+	for c.size < n {
+		c.size *= 2
+	}
+	if double && c.size < 4 {
+		c.size = 4
+	}
+	c.started = true
+	c.build()
+	cups = append(cups, c)
+	return c
+}
+
+// Play the cup out, the player with the lower name winning each match
+// unless upset names the winner of a round; return who played.
+func playcup(t *testing.T, c *Cup, upset map[string]string) []string {
+	var played []string
+	within(t, func() {
+		c.advance()
+		for c.champion == "" {
+			var m *Match
+			for _, mm := range c.matches {
+				if mm.game != nil && mm.winner == 0 {
+					m = mm
+					break
+				}
+			}
+			if m == nil {
+				t.Error("stuck")
+				return
+			}
+			a, b := playername(m.player(1)), playername(m.player(2))
+			w := 1
+			if b < a {
+				w = 2
+			}
+			if u, ok := upset[m.round]; ok {
+				w = 1
+				if u == b {
+					w = 2
+				}
+			}
+			played = append(played, m.round+" "+a+"-"+b)
+			m.game.state = Finished
+			m.settle(w)
+		}
+	})
+	return played
+}
+
+func TestCup(t *testing.T) {
+	for _, c := range []struct {
+		n       int
+		double  bool
+		upset   map[string]string
+		matches int    // In the bracket.
+		played  int    // Played out, without byes.
+		champ   string // The champion's nick.
+	}{
+		{2, false, nil, 1, 1, "p1"},
+		{3, false, nil, 3, 2, "p1"},
+		{8, false, nil, 7, 7, "p1"},
+		{8, false, map[string]string{"W3": "p2"}, 7, 7, "p2"},
+		{5, true, nil, 15, 8, "p1"},
+		{4, true, nil, 7, 6, "p1"},
+		{4, true, map[string]string{"GF": "p2"}, 7, 7, "p1"},
+		{4, true, map[string]string{"GF": "p2", "GF2": "p2"}, 7, 7, "p2"},
+	} {
+		testbot(t)
+		cup := testcup(c.n, c.double)
+		if len(cup.matches) != c.matches {
+			t.Errorf("%d players, double %t: %d matches, want %d", c.n, c.double, len(cup.matches), c.matches)
+		}
+		played := playcup(t, cup, c.upset)
+		if len(played) != c.played || playername(cup.champion) != c.champ {
+			t.Errorf("%d players, double %t, upsets %v: played %q, won by %s, want %d played, won by %s",
+				c.n, c.double, c.upset, played, cup.champion, c.played, c.champ)
+		}
+	}
+}
+
+// An aborted match waits for an operator or a forfeit rather than
+// starting again.
+func TestCupAbort(t *testing.T) {
+	testbot(t)
+	c := testcup(4, false)
+	within(t, c.advance)
+	m := c.matches[0]
+	g := m.game
+	within(t, g.abort)
+	if m.game != nil || !m.held || len(games) != 1 {
+		t.Fatalf("after abort: game %v, held %t, %d games", m.game, m.held, len(games))
+	}
+	within(t, c.advance)
+	if m.game != nil {
+		t.Fatal("aborted match was started again")
+	}
+	if !cup("#pickup", "p3!u@h", "forfeit") {
+		t.Fatal("p3 can't forfeit")
+	}
+	if m.winner != 0 || c.matches[1].winner != 1 || c.matches[2].slots[1].user != "p2!u@h" {
+		t.Errorf("forfeit settled %v", c.lines())
+	}
+	if cup("#pickup", "p3!u@h", "forfeit") {
+		t.Error("p3 forfeited twice")
+	}
+	if !cupreplay("#pickup", "op", "test", "1") || m.game == nil || m.held {
+		t.Errorf("replay: game %v, held %t", m.game, m.held)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// A captains' draft for a team mode that has filled.
+type Draft struct {
+	g         *Game      // The game being drafted.
+	caps      []Player   // Captains, one per team.
+	volunteer []bool     // Did the captain volunteer with !captain?
+	teams     [][]Player // Picked players, captains first.
+	pool      []Player   // Players yet to be picked.
+	order     string     // Pick order, e.g. "abba".
+	npicks    int        // Turns taken so far.
+	gen       int        // Bumped on each announcement to cancel stale timeouts.
+}
+
+const picktimeout = 45 * time.Second
+
+// Is s a pick order: a pattern of letters, one per team, or the name
+// of one?
+func validpickorder(s string) bool {
+	s = strings.ToLower(s)
+	if s == "alternate" || s == "snake" {
+		return true
+	}
+	return s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyz") == ""
+}
+
+// The pick order for n teams named or spelled by s, or "" if s doesn't
+// give every team a turn or names a team that doesn't exist.
+func pickorder(s string, n int) string {
+	letters := "abcdefghijklmnopqrstuvwxyz"[:n]
+	switch s = strings.ToLower(s); s {
+	case "", "alternate":
+		return letters
+	case "snake":
+		rev := []byte(letters)
+		for i, j := 0, len(rev)-1; i < j; i, j = i+1, j-1 {
+			rev[i], rev[j] = rev[j], rev[i]
+		}
+		return letters + string(rev)
+	}
+	if strings.Trim(s, letters) != "" {
+		return ""
+	}
+	for _, c := range letters {
+		if !strings.ContainsRune(s, c) {
+			return ""
+		}
+	}
+	return s
+}
+
+func newdraft(g *Game) *Draft {
+	n := len(g.caps)
+	d := &Draft{
+		g:         g,
+		caps:      make([]Player, n),
+		volunteer: make([]bool, n),
+		teams:     make([][]Player, n),
+		order:     pickorder(g.mode.pickorder, n),
+	}
+	if d.order == "" {
+		d.order = pickorder("alternate", n)
+	}
+	for _, u := range g.who {
+		nick, _, _ := splituserstring(u.user)
+		c := -1
+		for i := range g.caps {
+			if nick == g.caps[i] {
+				c = i
+			}
+		}
+		if c >= 0 {
+			d.caps[c], d.volunteer[c] = u, u.captain
+		} else {
+			d.pool = append(d.pool, u)
+		}
+	}
+	for i := range d.teams {
+		d.teams[i] = []Player{d.caps[i]}
+	}
+	g.state = Drafting
+	g.draft = d
+	return d
+}
+
+// Announce the captains and the first pick. With no one to pick the
+// game launches straight away, and with one player left they join the
+// team whose turn it is.
+func (d *Draft) start() {
+	if len(d.pool) == 0 {
+		d.finish()
+		return
+	}
+	s := csprintf("{orange}{b}%s{b} #%d is full {r}-> captains are %s; volunteers may still !captain",
+		d.g.name, d.g.id, d.g.capsstring())
+	irc.privmsg(channel, s)
+	if len(d.pool) == 1 {
+		d.pick(0)
+		return
+	}
+	d.announce()
+}
+
+// Find the draft that who is captaining or waiting to be picked in.
+func finddraft(who string) *Draft {
+	for _, g := range games {
+		d := g.draft
+		if d == nil {
+			continue
+		}
+		for _, u := range d.caps {
+			if u.user == who {
+				return d
+			}
+		}
+		for _, u := range d.pool {
+			if u.user == who {
+				return d
+			}
+		}
+	}
+	return nil
+}
+
+// Index of the captain whose turn it is to pick. Every team has a turn
+// in each round of the order, so if none of them has room the teams
+// are full and the smallest is returned.
+func (d *Draft) picker() int {
+	max := (len(d.g.who) + len(d.teams) - 1) / len(d.teams)
+	for n := 0; n < len(d.order); n++ {
+		i := int(d.order[d.npicks%len(d.order)] - 'a')
+		if len(d.teams[i]) < max {
+			return i
+		}
+		d.npicks++
+	}
+	min := 0
+	for i := range d.teams {
+		if len(d.teams[i]) < len(d.teams[min]) {
+			min = i
+		}
+	}
+	return min
+}
+
+func (d *Draft) pick(i int) {
+	t := d.picker()
+	d.teams[t] = append(d.teams[t], d.pool[i])
+	copy(d.pool[i:], d.pool[i+1:])
+	d.pool[len(d.pool)-1] = Player{}
+	d.pool = d.pool[:len(d.pool)-1]
+	d.npicks++
+	if len(d.pool) == 1 {
+		d.pick(0)
+		return
+	}
+	if len(d.pool) == 0 {
+		d.finish()
+		return
+	}
+	d.announce()
+}
+
+// Whose pick it is and who is left.
+func (d *Draft) String() string {
+	nicks := make([]string, len(d.pool))
+	for i, u := range d.pool {
+		nicks[i], _, _ = splituserstring(u.user)
+	}
+	cap, _, _ := splituserstring(d.caps[d.picker()].user)
+	return csprintf("{orange}{b}%s{b} #%d{r} -> %s to !pick from: {orange}%s",
+		d.g.name, d.g.id, teamcolour(d.picker()+1, cap), strings.Join(nicks, " "))
+}
+
+// Tell the channel whose pick it is and who is left.
+func (d *Draft) announce() {
+	irc.privmsg(channel, d.String())
+	d.gen++
+	gen := d.gen
+	after(picktimeout, func() {
+		if gen == d.gen && d.g.draft == d && len(d.pool) > 0 {
+			d.autopick()
+		}
+	})
+}
+
+// The captain took too long; pick for them.
+func (d *Draft) autopick() {
+	i := rand.Intn(len(d.pool))
+	cap, _, _ := splituserstring(d.caps[d.picker()].user)
+	nick, _, _ := splituserstring(d.pool[i].user)
+	irc.privmsg(channel, csprintf("{orange}%s{r} took too long; picked {orange}%s", cap, nick))
+	d.pick(i)
+}
+
+func (d *Draft) finish() {
+	d.g.setteams(d.teams)
+	for i := range d.caps {
+		d.g.caps[i], _, _ = splituserstring(d.caps[i].user)
+	}
+	d.g.launch()
+}
+
+func pick(where, who string, args ...string) bool {
+	if len(args) != 1 {
+		sayusage(where, who, "usage: !pick nick")
+		return false
+	}
+	d := finddraft(who)
+	if d == nil || d.caps[d.picker()].user != who {
+		sayusage(where, who, "it's not your turn to pick")
+		return false
+	}
+	for i, u := range d.pool {
+		nick, _, _ := splituserstring(u.user)
+		if strings.EqualFold(nick, args[0]) {
+			d.pick(i)
+			return true
+		}
+	}
+	sayusage(where, who, fmt.Sprintf("%s: not in the pool", args[0]))
+	return false
+}
+
+// Volunteer to captain. Before the first pick of a draft, a volunteer
+// in the pool replaces a captain that was chosen at random.
+func captain(where, who string, args ...string) bool {
+	if d := finddraft(who); d != nil {
+		if d.npicks > 0 {
+			sayusage(where, who, "the draft has already started")
+			return false
+		}
+		for _, u := range d.caps {
+			if u.user == who {
+				sayusage(where, who, "you are already a captain")
+				return false
+			}
+		}
+		for i, u := range d.pool {
+			if u.user != who {
+				continue
+			}
+			for c := range d.caps {
+				if d.volunteer[c] {
+					continue
+				}
+				d.pool[i], d.caps[c] = d.caps[c], u
+				d.teams[c] = []Player{u}
+				d.volunteer[c] = true
+				d.announce()
+				return true
+			}
+		}
+		sayusage(where, who, "all the captains have already volunteered")
+		return false
+	}
+	added := false
+	for _, m := range modes {
+		for i := range m.who {
+			if m.who[i].user == who {
+				m.who[i].captain = true
+				added = true
+			}
+		}
+	}
+	if !added {
+		sayusage(where, who, "you must !add before volunteering to captain")
+		return false
+	}
+	say(where, who, "you have volunteered to captain")
+	return true
+}
+
+func setpickorder(where, who string, args ...string) bool {
+	if len(args) != 2 {
+		usage := "usage: !pickorder mode order (e.g. ab, abba, snake)"
+		if initial {
+			log.Println(usage)
+		} else {
+			sayusage(where, who, usage)
+		}
+		return false
+	}
+	return modeset(where, who, args[0], "order", args[1])
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPickorder(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"", 2, "ab"},
+		{"alternate", 3, "abc"},
+		{"snake", 2, "abba"},
+		{"Snake", 3, "abccba"},
+		{"abba", 2, "abba"},
+		{"aab", 2, "aab"},
+		{"aaa", 2, ""}, // b never picks
+		{"abc", 2, ""}, // no team c
+		{"ab1", 2, ""}, // not a letter
+		{"bca", 3, "bca"},
+	} {
+		if got := pickorder(c.s, c.n); got != c.want {
+			t.Errorf("pickorder(%q, %d) = %q, want %q", c.s, c.n, got, c.want)
+		}
+	}
+}
+
+// A draft of n players into nt teams, the first nt of them captains.
+func testdraft(n, nt int, order string) *Draft {
+	m := &Mode{name: "test", nneeded: n, teams: nt, pickorder: order}
+	who := make([]Player, n)
+	for i := range who {
+		who[i].user = fmt.Sprintf("p%d!u@h", i)
+	}
+	g := newgame(m, who)
+	g.caps = make([]string, nt)
+	for i := range g.caps {
+		g.caps[i] = fmt.Sprintf("p%d", i)
+	}
+	return newdraft(g)
+}
+
+func TestDraftOrder(t *testing.T) {
+	for _, c := range []struct {
+		n, nt int
+		order string
+		want  string // The team of each pick, from a.
+	}{
+		{6, 2, "alternate", "aba"},
+		{6, 2, "snake", "abb"},
+		{8, 2, "snake", "abbaa"},
+		{6, 3, "alternate", "ab"},
+		{9, 3, "snake", "abccb"},
+		{5, 2, "aab", "aa"}, // Then a is full.
+		{7, 2, "abba", "abba"},
+	} {
+		testbot(t)
+		d := testdraft(c.n, c.nt, c.order)
+		got := ""
+		within(t, func() {
+			for len(d.pool) > 1 {
+				got += string(rune('a' + d.picker()))
+				d.pick(0)
+			}
+		})
+		// The last player is assigned without a turn.
+		if len(d.pool) != 0 || d.g.state != Playing {
+			t.Errorf("%d players, %d teams, %s: pool %d, state %v", c.n, c.nt, c.order, len(d.pool), d.g.state)
+		}
+		if got != c.want {
+			t.Errorf("%d players, %d teams, %s: picked %q, want %q", c.n, c.nt, c.order, got, c.want)
+		}
+	}
+}
+
+// Drafts with no one or one player to pick must launch at once rather
+// than wait for a pick that can't happen.
+func TestDraftSmallPool(t *testing.T) {
+	for _, c := range []struct{ n, nt int }{
+		{2, 2},
+		{4, 4},
+		{3, 2},
+		{5, 4},
+	} {
+		testbot(t)
+		d := testdraft(c.n, c.nt, "")
+		within(t, d.start)
+		if d.g.state != Playing || d.g.draft != nil {
+			t.Errorf("%d players, %d teams: state %v, draft %v", c.n, c.nt, d.g.state, d.g.draft)
+		}
+		for _, u := range d.g.who {
+			if u.team < 1 || u.team > c.nt {
+				t.Errorf("%d players, %d teams: %s on team %d", c.n, c.nt, u.user, u.team)
+			}
+		}
+		within(t, func() { d.picker() })
+	}
+}
+
+// Modes of one player a team start without a draft, whatever their pick
+// method.
+func TestDraftFullMode(t *testing.T) {
+	for _, c := range []struct {
+		teams, players int
+		pick           string
+	}{
+		{2, 2, "captains"},
+		{4, 4, "captains"},
+		{4, 4, "balance"},
+		{2, 3, "captains"},
+	} {
+		testbot(t)
+		m := &Mode{name: "test", nneeded: c.players}
+		if err := m.setattr("teams", fmt.Sprint(c.teams)); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.setattr("pick", c.pick); err != nil {
+			t.Fatal(err)
+		}
+		modes["test"] = m
+		for i := 0; i < c.players; i++ {
+			m.addplayer(fmt.Sprintf("p%d!u@h", i), time.Now())
+		}
+		within(t, m.startgame)
+		if len(games) != 1 || games[0].state != Playing {
+			t.Fatalf("%d teams of %d players, %s: games %v", c.teams, c.players, c.pick, games)
+		}
+		if len(m.who) != 0 {
+			t.Errorf("%d teams of %d players, %s: %d still added", c.teams, c.players, c.pick, len(m.who))
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// !expire sets the time in each mode, capped at the mode's maximum.
+func TestSetexpire(t *testing.T) {
+	testbot(t)
+	now := time.Now()
+	ctf := &Mode{name: "ctf", nneeded: 4, maxexpire: time.Hour}
+	duel := &Mode{name: "duel", nneeded: 2}
+	for _, m := range []*Mode{ctf, duel} {
+		m.who = []Player{{user: "alice!u@h", expire: now.Add(time.Minute), warned: true}}
+		modes[m.name] = m
+	}
+	if !setexpire("#pickup", "alice!u@h", "2h") {
+		t.Fatal("!expire 2h failed")
+	}
+	if d := time.Until(ctf.who[0].expire); d > time.Hour || d < 59*time.Minute {
+		t.Errorf("ctf expires in %v", d)
+	}
+	if d := time.Until(duel.who[0].expire); d > 2*time.Hour || d < 119*time.Minute || duel.who[0].warned {
+		t.Errorf("duel expires in %v, warned %t", d, duel.who[0].warned)
+	}
+	if s := <-irc.out; !strings.Contains(s, "capped in ctf to 1h0m0s") {
+		t.Errorf("said %q", s)
+	}
+}
+
+// Players are warned once before they expire, and removed when they do.
+func TestChkexpire(t *testing.T) {
+	testbot(t)
+	now := time.Now()
+	m := &Mode{name: "ctf", nneeded: 4, who: []Player{
+		{user: "alice!u@h", expire: now.Add(-time.Second)},
+		{user: "bob!u@h", expire: now.Add(expirewarn / 2)},
+		{user: "carol!u@h", expire: now.Add(time.Hour)},
+	}}
+	modes["ctf"] = m
+	chkexpire()
+	if len(m.who) != 2 || m.who[0].user != "bob!u@h" || !m.who[0].warned || m.who[1].warned {
+		t.Errorf("players %+v", m.who)
+	}
+	var out []string
+	for len(irc.out) > 0 {
+		out = append(out, <-irc.out)
+	}
+	if len(out) != 2 || !strings.HasPrefix(out[0], "NOTICE bob ") {
+		t.Errorf("sent %q", out)
+	}
+	chkexpire()
+	if len(irc.out) != 0 {
+		t.Errorf("warned again: %q", <-irc.out)
+	}
+}
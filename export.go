@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dumps of the history for other programs, such as stats sites.
+type Export struct {
+	Games   []ExportGame   `json:"games,omitempty"`
+	Players []ExportPlayer `json:"players,omitempty"`
+	Modes   []ExportMode   `json:"modes,omitempty"`
+}
+
+type ExportGame struct {
+	ID      int           `json:"id"` // 0 in entries from before game IDs.
+	Mode    string        `json:"mode"`
+	Start   time.Time     `json:"start"`
+	Length  int           `json:"length,omitempty"` // Seconds.
+	Server  string        `json:"server,omitempty"`
+	Host    string        `json:"host,omitempty"`
+	Map     string        `json:"map,omitempty"`
+	Winner  int           `json:"winner,omitempty"` // Team number.
+	Draw    bool          `json:"draw,omitempty"`
+	Players []ExportEntry `json:"players"`
+}
+
+// A player's part in a game.
+type ExportEntry struct {
+	Name    string `json:"name"`
+	Account string `json:"account,omitempty"`
+	Team    int    `json:"team,omitempty"`
+	Captain bool   `json:"captain,omitempty"`
+	Result  string `json:"result,omitempty"` // win, loss or draw.
+	SubFor  string `json:"subfor,omitempty"`
+}
+
+type ExportPlayer struct {
+	Name     string    `json:"name"`
+	Games    int       `json:"games"`
+	Wins     int       `json:"wins"`
+	Losses   int       `json:"losses"`
+	Draws    int       `json:"draws"`
+	Captains int       `json:"captains"`
+	Subs     int       `json:"subs"`
+	First    time.Time `json:"first"`
+	Last     time.Time `json:"last"`
+}
+
+type ExportMode struct {
+	Mode    string    `json:"mode"`
+	Games   int       `json:"games"`
+	Players int       `json:"players"`          // Different players.
+	Length  int       `json:"length,omitempty"` // Average seconds, of games with a length.
+	First   time.Time `json:"first"`
+	Last    time.Time `json:"last"`
+}
+
+const exportfile = "pickupexport" // Written by !export, plus the table and format.
+
+var exporttables = []string{"games", "entries", "players", "modes"}
+
+// The games from from up to to, optionally in one mode, and totals by
+// player and mode. Players are named by their main names. Old entries
+// without a game ID are taken to be from the same game if they have the
+// same mode and time.
+func buildexport(mode string, from, to time.Time) *Export {
+	e := new(Export)
+	bygame := make(map[string]int)
+	for _, h := range hist.since(from) {
+		if !h.t.Before(to) {
+			break
+		}
+		if mode != "" && !strings.EqualFold(h.mode, mode) {
+			continue
+		}
+		k := strconv.Itoa(h.id)
+		if h.id == 0 {
+			k = h.mode + "\t" + h.t.String()
+		}
+		i, ok := bygame[k]
+		if !ok {
+			i = len(e.Games)
+			bygame[k] = i
+			e.Games = append(e.Games, ExportGame{ID: h.id, Mode: h.mode, Start: h.t,
+				Length: int(h.length / time.Second), Server: h.server, Host: h.host, Map: h.mapname})
+		}
+		g := &e.Games[i]
+		switch h.result {
+		case "win":
+			g.Winner = h.team
+		case "draw":
+			g.Draw = true
+		}
+		g.Players = append(g.Players, ExportEntry{Name: mainname(h.nick), Account: h.account,
+			Team: h.team, Captain: h.captain, Result: h.result, SubFor: h.subfor})
+	}
+	players := make(map[string]*ExportPlayer)
+	ms := make(map[string]*ExportMode)
+	mplayers := make(map[string]map[string]bool)
+	mlength := make(map[string][2]int) // Total seconds and games.
+	for _, g := range e.Games {
+		mk := strings.ToLower(g.Mode)
+		m, ok := ms[mk]
+		if !ok {
+			m = &ExportMode{Mode: g.Mode, First: g.Start}
+			ms[mk] = m
+			mplayers[mk] = make(map[string]bool)
+		}
+		m.Games++
+		m.Last = g.Start
+		if g.Length > 0 {
+			l := mlength[mk]
+			mlength[mk] = [2]int{l[0] + g.Length, l[1] + 1}
+		}
+		for _, u := range g.Players {
+			pk := strings.ToLower(u.Name)
+			mplayers[mk][pk] = true
+			p, ok := players[pk]
+			if !ok {
+				p = &ExportPlayer{Name: u.Name, First: g.Start}
+				players[pk] = p
+			}
+			p.Games++
+			p.Last = g.Start
+			switch u.Result {
+			case "win":
+				p.Wins++
+			case "loss":
+				p.Losses++
+			case "draw":
+				p.Draws++
+			}
+			if u.Captain {
+				p.Captains++
+			}
+			if u.SubFor != "" {
+				p.Subs++
+			}
+		}
+	}
+	for _, p := range players {
+		e.Players = append(e.Players, *p)
+	}
+	sort.Slice(e.Players, func(i, j int) bool {
+		if e.Players[i].Games != e.Players[j].Games {
+			return e.Players[i].Games > e.Players[j].Games
+		}
+		return strings.ToLower(e.Players[i].Name) < strings.ToLower(e.Players[j].Name)
+	})
+	for k, m := range ms {
+		m.Players = len(mplayers[k])
+		if l := mlength[k]; l[1] > 0 {
+			m.Length = l[0] / l[1]
+		}
+		e.Modes = append(e.Modes, *m)
+	}
+	sort.Slice(e.Modes, func(i, j int) bool {
+		if e.Modes[i].Games != e.Modes[j].Games {
+			return e.Modes[i].Games > e.Modes[j].Games
+		}
+		return strings.ToLower(e.Modes[i].Mode) < strings.ToLower(e.Modes[j].Mode)
+	})
+	return e
+}
+
+// Write table of e to w in format, csv or json, and return how many rows
+// it has. An empty table means every table, which only json can hold.
+func (e *Export) write(w io.Writer, format, table string) (int, error) {
+	if format == "json" {
+		n := 0
+		switch table {
+		case "":
+			n = len(e.Games) + len(e.Players) + len(e.Modes)
+		case "games", "entries":
+			// Games hold their entries.
+			e = &Export{Games: e.Games}
+			n = len(e.Games)
+		case "players":
+			e = &Export{Players: e.Players}
+			n = len(e.Players)
+		case "modes":
+			e = &Export{Modes: e.Modes}
+			n = len(e.Modes)
+		}
+		b, err := json.MarshalIndent(e, "", "\t")
+		if err != nil {
+			return 0, err
+		}
+		_, err = w.Write(append(b, '\n'))
+		return n, err
+	}
+	const tf = time.RFC3339
+	var rows [][]string
+	switch table {
+	case "games":
+		rows = append(rows, []string{"id", "mode", "start", "length", "server", "host", "map", "winner", "draw", "players"})
+		for _, g := range e.Games {
+			names := make([]string, len(g.Players))
+			for i, u := range g.Players {
+				names[i] = u.Name
+			}
+			rows = append(rows, []string{strconv.Itoa(g.ID), g.Mode, g.Start.Format(tf), strconv.Itoa(g.Length),
+				g.Server, g.Host, g.Map, strconv.Itoa(g.Winner), strconv.FormatBool(g.Draw), strings.Join(names, " ")})
+		}
+	case "entries":
+		rows = append(rows, []string{"id", "mode", "start", "name", "account", "team", "captain", "result", "subfor"})
+		for _, g := range e.Games {
+			for _, u := range g.Players {
+				rows = append(rows, []string{strconv.Itoa(g.ID), g.Mode, g.Start.Format(tf), u.Name, u.Account,
+					strconv.Itoa(u.Team), strconv.FormatBool(u.Captain), u.Result, u.SubFor})
+			}
+		}
+	case "players":
+		rows = append(rows, []string{"name", "games", "wins", "losses", "draws", "captains", "subs", "first", "last"})
+		for _, p := range e.Players {
+			rows = append(rows, []string{p.Name, strconv.Itoa(p.Games), strconv.Itoa(p.Wins), strconv.Itoa(p.Losses),
+				strconv.Itoa(p.Draws), strconv.Itoa(p.Captains), strconv.Itoa(p.Subs), p.First.Format(tf), p.Last.Format(tf)})
+		}
+	case "modes":
+		rows = append(rows, []string{"mode", "games", "players", "length", "first", "last"})
+		for _, m := range e.Modes {
+			rows = append(rows, []string{m.Mode, strconv.Itoa(m.Games), strconv.Itoa(m.Players),
+				strconv.Itoa(m.Length), m.First.Format(tf), m.Last.Format(tf)})
+		}
+	default:
+		return 0, errors.New("csv holds one table: games, entries, players or modes")
+	}
+	cw := csv.NewWriter(w)
+	cw.WriteAll(rows)
+	return len(rows) - 1, cw.Error()
+}
+
+// Write the export to fname, replacing it only once it is complete.
+func (e *Export) writefile(fname, format, table string) (int, error) {
+	var n int
+	err := writeatomic(fname, func(w *bufio.Writer) error {
+		var err error
+		n, err = e.write(w, format, table)
+		return err
+	})
+	return n, err
+}
+
+// The "pkup export" command, run instead of the bot.
+func exportmain(args []string) {
+	log.SetFlags(0)
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "json", "output format, csv or json")
+	mode := fs.String("mode", "", "only games of this mode")
+	period := fs.String("period", "all", "only games in this period: all, week, month, year, a duration such as 3d, or a date such as 2026, 2026-09 or 2026-09-01")
+	out := fs.String("o", "", "file to write instead of standard output")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: pkup [ flags ] export [ -format csv|json ] [ -mode mode ] [ -period period ] [ -o file ] [ games|entries|players|modes ]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 || (*format != "csv" && *format != "json") {
+		fs.Usage()
+		os.Exit(2)
+	}
+	table := fs.Arg(0)
+	if table == "" && *format == "csv" {
+		table = "games"
+	}
+	if table != "" && !containsfold(exporttables, table) {
+		fs.Usage()
+		os.Exit(2)
+	}
+	from, to, _, err := parseperiod(*period, deftz)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	// Read without creating or rewriting anything.
+	if _, err := os.Stat(aliasfile); err == nil {
+		if err := readaliases(aliasfile); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if hist, err = readhistdb(histdbfile); err != nil {
+		log.Fatalln(err)
+	}
+	e := buildexport(*mode, from, to)
+	if *out != "" {
+		_, err = e.writefile(*out, *format, strings.ToLower(table))
+	} else {
+		_, err = e.write(os.Stdout, *format, strings.ToLower(table))
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func export(where, who string, args ...string) bool {
+	usage := "usage: !export [csv|json] [games|entries|players|modes] [mode] [period]"
+	format, table, mode := "json", "", ""
+	period := "all"
+	for _, a := range args {
+		switch l := strings.ToLower(a); {
+		case l == "csv" || l == "json":
+			format = l
+		case containsfold(exporttables, l):
+			table = l
+		case ismode(a):
+			mode = a
+		default:
+			if _, _, _, err := parseperiod(a, time.UTC); err != nil {
+				sayusage(where, who, usage)
+				return false
+			}
+			period = a
+		}
+	}
+	if table == "" && format == "csv" {
+		table = "games"
+	}
+	from, to, desc, _ := parseperiod(period, zonefor(who))
+	fname := exportfile
+	if table != "" {
+		fname += "-" + table
+	}
+	fname += "." + format
+	n, err := buildexport(mode, from, to).writefile(fname, format, table)
+	if err != nil {
+		log.Println(err)
+		sayusage(where, who, "the export could not be written")
+		return false
+	}
+	what := "games"
+	if mode != "" {
+		what += " of " + mode
+	}
+	say(where, who, fmt.Sprintf("wrote %d rows to %s from %s %s", n, fname, what, desc))
+	return true
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Reading the history for an export must leave its files alone.
+func TestReadhistdb(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if _, err := readhistdb(histdbfile); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing history: %v", err)
+	}
+	if _, err := os.Stat(histdbfile); !errors.Is(err, os.ErrNotExist) {
+		t.Error("missing history was created")
+	}
+	var b strings.Builder
+	for i := 0; i < histcompact+1; i++ {
+		b.WriteString("+\t2026-09-01 20:30\tctf\talice\t1\t1\n-\t1\n")
+	}
+	b.WriteString("+\t2026-09-01 20:30\tctf\talice\t1\t2\n")
+	want := b.String()
+	os.WriteFile(histdbfile, []byte(want), 0644)
+	os.WriteFile(histfile, []byte("2026-09-01 20:30\tctf\tbob\n"), 0644)
+	db, err := readhistdb(histdbfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db.recs) != 1 || db.recs[0].id != 2 {
+		t.Errorf("read %+v", db.recs)
+	}
+	if got, _ := os.ReadFile(histdbfile); string(got) != want {
+		t.Error("history was compacted")
+	}
+	if _, err := os.Stat(histfile); err != nil {
+		t.Error("old history was moved")
+	}
+}
+
+func TestExport(t *testing.T) {
+	testbot(t)
+	aliases["alice_"] = "alice"
+	start := time.Date(2026, 9, 1, 20, 0, 0, 0, time.UTC)
+	hist.add([]HistVal{
+		{v: 2, t: start, mode: "ctf", nick: "alice", team: 1, id: 1, captain: true, result: "win", length: time.Hour},
+		{v: 2, t: start, mode: "ctf", nick: "bob", team: 2, id: 1, result: "loss", length: time.Hour},
+		{t: start.Add(time.Hour), mode: "duel", nick: "alice_"},
+		{t: start.Add(time.Hour), mode: "duel", nick: "carol"},
+		{v: 2, t: start.Add(48 * time.Hour), mode: "ctf", nick: "bob", team: 1, id: 2, result: "draw"},
+	})
+	e := buildexport("", time.Time{}, start.Add(24*time.Hour))
+	if len(e.Games) != 2 || e.Games[0].Winner != 1 || e.Games[1].ID != 0 || len(e.Games[1].Players) != 2 {
+		t.Errorf("games %+v", e.Games)
+	}
+	if len(e.Players) != 3 || e.Players[0].Name != "alice" || e.Players[0].Games != 2 || e.Players[0].Wins != 1 {
+		t.Errorf("players %+v", e.Players)
+	}
+	if len(e.Modes) != 2 || e.Modes[0].Mode != "ctf" || e.Modes[0].Length != 3600 || e.Modes[1].Players != 2 {
+		t.Errorf("modes %+v", e.Modes)
+	}
+	if e := buildexport("duel", time.Time{}, start.Add(72*time.Hour)); len(e.Games) != 1 || len(e.Modes) != 1 {
+		t.Errorf("duel games %+v", e.Games)
+	}
+	for _, c := range []struct {
+		format, table string
+		rows          int
+		head          string
+	}{
+		{"csv", "games", 2, "id,mode,start,length,server,host,map,winner,draw,players\n1,ctf,2026-09-01T20:00:00Z,3600,,,,1,false,alice bob\n"},
+		{"csv", "entries", 4, "id,mode,start,name,account,team,captain,result,subfor\n1,ctf,2026-09-01T20:00:00Z,alice,,1,true,win,\n"},
+		{"csv", "players", 3, "name,games,wins,losses,draws,captains,subs,first,last\nalice,2,1,0,0,1,0,"},
+		{"csv", "modes", 2, "mode,games,players,length,first,last\nctf,1,2,3600,"},
+		{"json", "", 7, "{\n\t\"games\": ["},
+		{"json", "players", 3, "{\n\t\"players\": ["},
+	} {
+		var b bytes.Buffer
+		n, err := e.write(&b, c.format, c.table)
+		if err != nil || n != c.rows || !strings.HasPrefix(b.String(), c.head) {
+			t.Errorf("%s %s: %d rows, %v:\n%s", c.format, c.table, n, err, b.String())
+		}
+		if c.format == "json" && !json.Valid(b.Bytes()) {
+			t.Errorf("%s %s: invalid JSON", c.format, c.table)
+		}
+	}
+	if _, err := e.write(new(bytes.Buffer), "csv", ""); err == nil {
+		t.Error("csv of every table was written")
+	}
+}
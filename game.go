@@ -0,0 +1,446 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type State int
+
+const (
+	Drafting State = iota // Captains are picking teams.
+	Voting                // Teams are ready but the map vote is still open.
+	Playing               // Started; team games await a result.
+	Finished              // Reported, or too old to report.
+)
+
+// A game started from a mode that filled.
+type Game struct {
+	id         int
+	mode       *Mode    // The mode it started from.
+	name       string   // The mode's name when it started.
+	who        []Player // Players, with their teams once picked.
+	teamnames  []string // Team names, if it's a team game.
+	caps       []string // Captains' nicks, one per team.
+	srv        Server   // Chosen server, or nil.
+	mapname    string   // Map from the mode's pool, or "".
+	started    time.Time
+	state      State
+	reported   bool                // Has the result been reported?
+	winner     int                 // Winning team once reported, 0 for a draw.
+	draft      *Draft              // The captains' draft while drafting.
+	vote       *MapVote            // The map vote while it is open.
+	needsub    []string            // Players looking for a sub.
+	prev       map[string][]Player // Every mode's players before the start.
+	abortvotes map[string]bool     // Players who voted to !abort.
+	votes      map[string]int      // Winning team reported by each player.
+	ladder     bool                // Is it a duel from a !challenge?
+	cupmatch   *Match              // The cup match it decides, if any.
+}
+
+const (
+	maxgames   = 50            // Games kept for !lastgame and friends.
+	gamelength = 3 * time.Hour // Games are finished this long after starting.
+	maxteams   = 8             // Most teams a mode may have.
+)
+
+var (
+	defaultteamnames = []string{"Red", "Blue", "Green", "Yellow", "Cyan", "Violet", "Orange", "Grey"}
+	teamcolours      = []string{Red, Blue, Ltgreen, Yellow, Cyan, Violet, Orange, Ltgrey}
+)
+
+var (
+	games      []*Game // Recent games, oldest first.
+	nextgameid = 1
+)
+
+var statenames = map[State]string{
+	Drafting: "drafting",
+	Voting:   "voting",
+	Playing:  "playing",
+	Finished: "finished",
+}
+
+func (s State) String() string {
+	return statenames[s]
+}
+
+// A game of m for players who, remembering every mode's players in
+// case it is aborted.
+func newgame(m *Mode, who []Player) *Game {
+	g := &Game{
+		id:         nextgameid,
+		mode:       m,
+		name:       m.name,
+		srv:        m.srv,
+		started:    time.Now(),
+		state:      Playing,
+		prev:       make(map[string][]Player, len(modes)),
+		abortvotes: make(map[string]bool),
+		votes:      make(map[string]int),
+	}
+	nextgameid++
+	g.who = make([]Player, len(who))
+	copy(g.who, who)
+	if nt := m.nteams(); nt >= 2 {
+		g.teamnames = make([]string, nt)
+		for t := range g.teamnames {
+			g.teamnames[t] = m.teamname(t + 1)
+		}
+	}
+	for k, mm := range modes {
+		g.prev[k] = mm.clone().who
+	}
+	games = append(games, g)
+	if len(games) > maxgames {
+		games = games[1:]
+	}
+	return g
+}
+
+func (g *Game) teamgame() bool {
+	return len(g.teamnames) >= 2 && len(g.who) >= len(g.teamnames)
+}
+
+// s in the colour of team t, counting from 1.
+func teamcolour(t int, s string) string {
+	return teamcolours[(t-1)%len(teamcolours)] + s + Reset
+}
+
+// The name of team t in its colour.
+func (g *Game) teamname(t int) string {
+	return teamcolour(t, g.teamnames[t-1])
+}
+
+// Not launched yet, or playing and not yet too old to report.
+func (g *Game) active() bool {
+	return g.state < Playing ||
+		(g.state == Playing && time.Since(g.started) < gamelength)
+}
+
+// Finish games that have gone on too long to still be in progress.
+func chkgames() {
+	for _, g := range games {
+		if g.state == Playing && !g.active() {
+			g.state = Finished
+		}
+	}
+}
+
+func removegame(g *Game) {
+	for i := range games {
+		if games[i] == g {
+			games = append(games[:i], games[i+1:]...)
+			return
+		}
+	}
+}
+
+func findgameid(id int) *Game {
+	for _, g := range games {
+		if g.id == id {
+			return g
+		}
+	}
+	return nil
+}
+
+// The most recent active game that who played in, optionally narrowed
+// down by a game ID or mode name.
+func findgame(who, game string) *Game {
+	id, _ := strconv.Atoi(strings.TrimPrefix(game, "#"))
+	for i := len(games) - 1; i >= 0; i-- {
+		g := games[i]
+		if !g.active() ||
+			(game != "" && g.id != id && !strings.EqualFold(g.name, game)) {
+			continue
+		}
+		if g.playerindex(who) >= 0 {
+			return g
+		}
+	}
+	return nil
+}
+
+// Index of who in ps, or -1.
+func findplayer(ps []Player, who string) int {
+	for i, u := range ps {
+		if u.user == who {
+			return i
+		}
+	}
+	return -1
+}
+
+// Index of who in g.who, or -1.
+func (g *Game) playerindex(who string) int {
+	return findplayer(g.who, who)
+}
+
+// Index of the player called nick in g.who, or -1.
+func (g *Game) nickindex(nick string) int {
+	for i, u := range g.who {
+		n, _, _ := splituserstring(u.user)
+		if strings.EqualFold(n, nick) {
+			return i
+		}
+	}
+	return -1
+}
+
+// The team who played on, or 0.
+func (g *Game) team(who string) int {
+	if i := g.playerindex(who); i >= 0 {
+		return g.who[i].team
+	}
+	return 0
+}
+
+// Announce and log a game whose teams, if any, have been picked, or
+// wait for its map vote to close.
+func (g *Game) launch() {
+	g.draft = nil
+	if g.vote != nil {
+		g.state = Voting
+		return
+	}
+	g.state = Playing
+	g.promotestarting()
+	loggamestart(g)
+}
+
+// Replace the players with teams, numbering them from 1. The captain of
+// each team is a volunteer if there is one, otherwise its first player.
+func (g *Game) setteams(teams [][]Player) {
+	g.who = g.who[:0]
+	for t := range teams {
+		for _, u := range teams[t] {
+			u.team = t + 1
+			g.who = append(g.who, u)
+		}
+	}
+	g.caps = make([]string, len(teams))
+	vol := make([]bool, len(teams))
+	for _, u := range g.who {
+		t := u.team - 1
+		if g.caps[t] == "" || (u.captain && !vol[t]) {
+			g.caps[t], _, _ = splituserstring(u.user)
+			vol[t] = u.captain
+		}
+	}
+}
+
+func (g *Game) avgrating(team int) float64 {
+	sum, n := 0.0, 0
+	for _, u := range g.who {
+		if u.team == team {
+			sum += rating(g.name, playername(u.user))
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / float64(n)
+}
+
+// Pick a captain for each team, preferring players who volunteered
+// with !captain.
+func (g *Game) pickcaptains() {
+	var vols, rest []string
+	for _, i := range rand.Perm(len(g.who)) {
+		nick, _, _ := splituserstring(g.who[i].user)
+		if g.who[i].captain {
+			vols = append(vols, nick)
+		} else {
+			rest = append(rest, nick)
+		}
+	}
+	g.caps = append(vols, rest...)[:len(g.teamnames)]
+}
+
+func (g *Game) nicks() []string {
+	nicks := make([]string, len(g.who))
+	for i, u := range g.who {
+		nicks[i], _, _ = splituserstring(u.user)
+	}
+	return nicks
+}
+
+// Team listing, e.g. "a b c vs d e f", coloured by team.
+func (g *Game) teamsstring() string {
+	nicks := make([][]string, len(g.teamnames))
+	for _, u := range g.who {
+		if u.team >= 1 && u.team <= len(nicks) {
+			nick, _, _ := splituserstring(u.user)
+			nicks[u.team-1] = append(nicks[u.team-1], nick)
+		}
+	}
+	teams := make([]string, len(nicks))
+	for t := range nicks {
+		teams[t] = teamcolour(t+1, strings.Join(nicks[t], " "))
+	}
+	return strings.Join(teams, " vs ")
+}
+
+// The captains coloured by team, e.g. "a, b and c".
+func (g *Game) capsstring() string {
+	caps := make([]string, len(g.caps))
+	for i := range g.caps {
+		caps[i] = teamcolour(i+1, g.caps[i])
+	}
+	if len(caps) < 2 {
+		return strings.Join(caps, "")
+	}
+	return strings.Join(caps[:len(caps)-1], ", ") + " and " + caps[len(caps)-1]
+}
+
+// Players, and the captains if it's a team game.
+func (g *Game) playersstring() string {
+	switch {
+	case g.teamgame() && g.state != Drafting && len(g.who) == len(g.teamnames):
+		return g.teamsstring()
+	case g.teamgame() && g.state != Drafting:
+		return g.teamsstring() + " || team captains are " + g.capsstring()
+	}
+	return strings.Join(g.nicks(), " ")
+}
+
+func (g *Game) connectstring() string {
+	if g.srv == nil {
+		return Violet + "but there are no online servers in its pool =["
+	}
+	host := fmt.Sprintf("%s:%s", g.srv.host(), g.srv.port())
+	if g.srv.password() != "" {
+		return csprintf("{pink}{b}connect %s;password %s", host, g.srv.password())
+	}
+	return csprintf("{pink}{b}connect %s", host)
+}
+
+func (g *Game) promotestarting() {
+	srvstr := g.connectstring()
+	if g.srv != nil {
+		s := csprintf("{cyan}%s{r} -> {dkblue}%s {green}[%d/%d] {orange}(%v)",
+			g.srv.alias(), g.srv.hostname(), len(g.srv.clients()), g.srv.maxclients(), g.srv.ping())
+		irc.privmsg(channel, s)
+	}
+	mapstr := ""
+	if g.mapname != "" {
+		mapstr = csprintf(" on {b}%s{b}", g.mapname)
+	}
+	s := csprintf("{orange}{b}%s{b} #%d%s is starting {r}-> %s {r}<- {orange}%s",
+		g.name, g.id, mapstr, srvstr, g.playersstring())
+	irc.privmsg(channel, s)
+	captainsstr := ""
+	if g.teamgame() && len(g.who) > len(g.teamnames) {
+		captainsstr = Reset + " || team captains are " + g.capsstring()
+	}
+	// After a delay, PM everyone added.
+	go func(nicks []string) {
+		time.Sleep(2 * time.Second)
+		for _, nick := range nicks {
+			s := csprintf("{orange}{b}%s{b} #%d%s is starting {r}-> %s {r}<- {orange}%s%s",
+				g.name, g.id, mapstr, srvstr, nick, captainsstr)
+			irc.privmsg(nick, s)
+			time.Sleep(60 * time.Millisecond)
+		}
+	}(g.nicks())
+}
+
+// One-line summary for !games and !game.
+func (g *Game) String() string {
+	age := time.Since(g.started).Round(time.Minute)
+	srv := "no server"
+	if g.srv != nil {
+		srv = g.srv.alias()
+	}
+	if g.mapname != "" {
+		srv = g.mapname + " on " + srv
+	}
+	state := g.state.String()
+	if g.reported {
+		state = "drawn"
+		if g.winner != 0 {
+			state = "won by " + g.teamname(g.winner)
+		}
+	}
+	return csprintf("{orange}{b}%s{b} #%d{r} (%s, %v ago on %s): {orange}%s",
+		g.name, g.id, state, age, srv, g.playersstring())
+}
+
+func listgames(where, who string, args ...string) bool {
+	n := 0
+	for _, g := range games {
+		if g.active() {
+			say(where, who, g.String())
+			time.Sleep(60 * time.Millisecond)
+			n++
+		}
+	}
+	if n == 0 {
+		say(where, who, "no games in progress")
+	}
+	return true
+}
+
+func showgame(where, who string, args ...string) bool {
+	if len(args) != 1 {
+		sayusage(where, who, "usage: !game id")
+		return false
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		sayusage(where, who, "usage: !game id")
+		return false
+	}
+	g := findgameid(id)
+	if g == nil {
+		sayusage(where, who, fmt.Sprintf("#%d: no such game", id))
+		return false
+	}
+	say(where, who, g.String())
+	if g.draft != nil {
+		say(where, who, g.draft.String())
+	}
+	if g.vote != nil {
+		say(where, who, g.vote.String())
+	}
+	return true
+}
+
+// Show the last game, the last game of a mode, or the nth last game.
+func showlastgame(where, who string, args ...string) bool {
+	var g *Game
+	n := 1
+	mode := ""
+	if len(args) > 0 {
+		var err error
+		if n, err = strconv.Atoi(args[0]); err != nil {
+			n, mode = 1, args[0]
+		}
+	}
+	for i := len(games) - 1; i >= 0 && n > 0; i-- {
+		if games[i].state < Playing ||
+			(mode != "" && !strings.EqualFold(games[i].name, mode)) {
+			continue
+		}
+		if n--; n == 0 {
+			g = games[i]
+		}
+	}
+	if g == nil {
+		say(where, who, "none")
+		return false
+	}
+	mapstr := ""
+	if g.mapname != "" {
+		mapstr = csprintf(" on {b}%s{b}", g.mapname)
+	}
+	s := csprintf("{orange}{b}%s{b} #%d%s is ready {r}-> %s {r}<- {orange}%s",
+		g.name, g.id, mapstr, g.connectstring(), g.playersstring())
+	say(where, who, s)
+	return true
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The game history: an append-only log of records, held in memory
+// with indexes by time, mode and player. A record is a history entry
+// added ("+") or the entries of a game struck out ("-"), so that subs
+// and aborts don't rewrite the file. Superseded records are compacted
+// away when the log is opened. It is kept in memory rather than in an
+// embedded database since pkup uses only the standard library.
+type HistDB struct {
+	fname  string
+	recs   []HistVal        // Entries, oldest first.
+	bymode map[string][]int // Indexes into recs by lower-cased mode.
+	bynick map[string][]int // Indexes into recs by lower-cased player name.
+	byid   map[int][]int    // Indexes into recs by game ID.
+	dead   int              // Records in the file that no longer count.
+}
+
+const (
+	histversion = 2 // Format of new entries.
+	histdbfile  = "pickuphistory.db"
+	histcompact = 1000 // Dead records that trigger compaction.
+)
+
+var hist *HistDB
+
+// Open the history in fname, first moving the entries of the old
+// history log logname into it if fname doesn't exist yet.
+func openhist(fname, logname string) (*HistDB, error) {
+	db := &HistDB{fname: fname}
+	if _, err := os.Stat(fname); errors.Is(err, os.ErrNotExist) {
+		if _, err := os.Stat(logname); err == nil {
+			if err := db.migrate(logname); err != nil {
+				return nil, err
+			}
+			return db, nil
+		}
+	}
+	f, err := os.OpenFile(fname, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := db.read(f); err != nil {
+		return nil, err
+	}
+	if db.dead >= histcompact {
+		if err := db.compact(); err != nil {
+			log.Println(err)
+		}
+	}
+	return db, nil
+}
+
+// Open the history in fname only to read it. Unlike openhist, it
+// never migrates or compacts, so it is safe beside a running bot.
+func readhistdb(fname string) (*HistDB, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	db := &HistDB{fname: fname}
+	if err := db.read(f); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Read the records in r and index the entries that still count.
+func (db *HistDB) read(r io.Reader) error {
+	byid := make(map[int][]int) // Live entries by game ID.
+	var struck []bool
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		op, rest, _ := strings.Cut(sc.Text(), "\t")
+		switch op {
+		case "+":
+			h, err := parsehist(rest)
+			if err != nil {
+				log.Println(err)
+				db.dead++
+				continue
+			}
+			if h.id != 0 {
+				byid[h.id] = append(byid[h.id], len(db.recs))
+			}
+			db.recs = append(db.recs, h)
+			struck = append(struck, false)
+		case "-":
+			id, err := strconv.Atoi(rest)
+			if err != nil || id == 0 {
+				log.Println("bad entry in history")
+			}
+			for _, i := range byid[id] {
+				struck[i] = true
+			}
+			db.dead += len(byid[id]) + 1
+			delete(byid, id)
+		default:
+			log.Println("bad entry in history")
+			db.dead++
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	recs := db.recs[:0]
+	for i, h := range db.recs {
+		if !struck[i] {
+			recs = append(recs, h)
+		}
+	}
+	db.recs = recs
+	sort.SliceStable(db.recs, func(i, j int) bool { return db.recs[i].t.Before(db.recs[j].t) })
+	db.index()
+	return nil
+}
+
+// Read the old history log into the store and set the log aside.
+func (db *HistDB) migrate(logname string) error {
+	log.Printf("migrating %s to %s\n", logname, db.fname)
+	recs, err := readhist(logname)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(recs, func(i, j int) bool { return recs[i].t.Before(recs[j].t) })
+	db.recs = recs
+	db.index()
+	if err := db.compact(); err != nil {
+		return err
+	}
+	return os.Rename(logname, logname+".old")
+}
+
+// Rebuild the indexes.
+func (db *HistDB) index() {
+	db.bymode = make(map[string][]int)
+	db.bynick = make(map[string][]int)
+	db.byid = make(map[int][]int)
+	for i := range db.recs {
+		db.addindex(i)
+	}
+}
+
+func (db *HistDB) addindex(i int) {
+	h := db.recs[i]
+	m, n := strings.ToLower(h.mode), strings.ToLower(h.nick)
+	db.bymode[m] = append(db.bymode[m], i)
+	db.bynick[n] = append(db.bynick[n], i)
+	if h.id != 0 {
+		db.byid[h.id] = append(db.byid[h.id], i)
+	}
+}
+
+// Rewrite the file with just the entries.
+func (db *HistDB) compact() error {
+	err := writeatomic(db.fname, func(w *bufio.Writer) error {
+		for _, h := range db.recs {
+			fmt.Fprintf(w, "+\t%s\n", h)
+		}
+		return nil
+	})
+	if err == nil {
+		db.dead = 0
+	}
+	return err
+}
+
+// Append records to the file.
+func (db *HistDB) write(lines []string) error {
+	f, err := os.OpenFile(db.fname, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, s := range lines {
+		fmt.Fprintln(w, s)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Add entries.
+func (db *HistDB) add(hs []HistVal) error {
+	lines := make([]string, len(hs))
+	sorted := true
+	for i, h := range hs {
+		lines[i] = "+\t" + h.String()
+		if n := len(db.recs); n > 0 && h.t.Before(db.recs[n-1].t) {
+			sorted = false
+		}
+		db.recs = append(db.recs, h)
+		if sorted {
+			db.addindex(len(db.recs) - 1)
+		}
+	}
+	if !sorted {
+		// The clock went back.
+		sort.SliceStable(db.recs, func(i, j int) bool { return db.recs[i].t.Before(db.recs[j].t) })
+		db.index()
+	}
+	return db.write(lines)
+}
+
+// Change the entries of game id with fn, dropping those for which it
+// returns false. Old entries are rewritten in the current format. The
+// entries keep their places, so fn mustn't change their times or modes.
+func (db *HistDB) edit(id int, fn func(*HistVal) bool) error {
+	is := db.byid[id]
+	if id == 0 || len(is) == 0 {
+		return nil
+	}
+	lines := []string{fmt.Sprintf("-\t%d", id)}
+	var drop []int
+	for _, i := range is {
+		h := &db.recs[i]
+		old := strings.ToLower(h.nick)
+		if !fn(h) {
+			drop = append(drop, i)
+			continue
+		}
+		h.v = histversion
+		if n := strings.ToLower(h.nick); n != old {
+			db.bynick[old] = removeindex(db.bynick[old], i)
+			db.bynick[n] = insertindex(db.bynick[n], i)
+		}
+		lines = append(lines, "+\t"+h.String())
+	}
+	db.dead += len(is) + 1
+	if len(drop) > 0 {
+		for j := len(drop) - 1; j >= 0; j-- {
+			i := drop[j]
+			db.recs = append(db.recs[:i], db.recs[i+1:]...)
+		}
+		db.index()
+	}
+	return db.write(lines)
+}
+
+// is without i.
+func removeindex(is []int, i int) []int {
+	j := sort.SearchInts(is, i)
+	if j < len(is) && is[j] == i {
+		is = append(is[:j], is[j+1:]...)
+	}
+	return is
+}
+
+// is with i, in order.
+func insertindex(is []int, i int) []int {
+	j := sort.SearchInts(is, i)
+	is = append(is, 0)
+	copy(is[j+1:], is[j:])
+	is[j] = i
+	return is
+}
+
+// Rename the players of entries to what fn returns, rewriting the file
+// if any change, and return how many did.
+func (db *HistDB) rename(fn func(string) string) (int, error) {
+	n := 0
+	for i := range db.recs {
+		if name := fn(db.recs[i].nick); name != db.recs[i].nick {
+			db.recs[i].nick = name
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	db.index()
+	return n, db.compact()
+}
+
+// Entries since t, oldest first.
+func (db *HistDB) since(t time.Time) []HistVal {
+	i := sort.Search(len(db.recs), func(i int) bool { return !db.recs[i].t.Before(t) })
+	return db.recs[i:]
+}
+
+// Entries for mode, oldest first.
+func (db *HistDB) mode(name string) []HistVal {
+	return db.lookup(db.bymode[strings.ToLower(name)])
+}
+
+// Entries for the player name and their aliases, oldest first.
+func (db *HistDB) player(name string) []HistVal {
+	main := mainname(name)
+	is := append([]int(nil), db.bynick[strings.ToLower(main)]...)
+	for _, alt := range altsof(main) {
+		is = append(is, db.bynick[alt]...)
+	}
+	sort.Ints(is)
+	return db.lookup(is)
+}
+
+// Entries for game id.
+func (db *HistDB) game(id int) []HistVal {
+	return db.lookup(db.byid[id])
+}
+
+func (db *HistDB) lookup(is []int) []HistVal {
+	hs := make([]HistVal, len(is))
+	for i, j := range is {
+		hs[i] = db.recs[j]
+	}
+	return hs
+}
+
+// The highest game ID in the history.
+func (db *HistDB) lastid() int {
+	id := 0
+	for _, h := range db.recs {
+		if h.id > id {
+			id = h.id
+		}
+	}
+	return id
+}
+
+// A version 2 entry: time, mode, player, team, game ID, account,
+// server alias and host, map, captain, result, sub for and length in
+// seconds.
+func parsehist2(ss []string) (HistVal, error) {
+	if len(ss) != 13 {
+		return HistVal{}, errors.New("bad entry in history")
+	}
+	t, err := time.Parse(time.RFC3339, ss[0])
+	if err != nil {
+		return HistVal{}, err
+	}
+	h := HistVal{v: histversion, t: t, mode: ss[1], nick: ss[2], account: ss[5],
+		server: ss[6], host: ss[7], mapname: ss[8], captain: ss[9] == "true",
+		result: ss[10], subfor: ss[11]}
+	h.team, _ = strconv.Atoi(ss[3])
+	h.id, _ = strconv.Atoi(ss[4])
+	secs, _ := strconv.Atoi(ss[12])
+	h.length = time.Duration(secs) * time.Second
+	return h, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsehist(t *testing.T) {
+	local := func(s string) time.Time {
+		t, _ := time.ParseInLocation(tlayout, s, time.Local)
+		return t
+	}
+	for _, c := range []struct {
+		line string
+		want HistVal
+		bad  bool
+	}{
+		{line: "2026-09-01 20:30\tctf\talice",
+			want: HistVal{t: local("2026-09-01 20:30"), mode: "ctf", nick: "alice"}},
+		{line: "2026-09-01 20:30\tctf\talice\t2",
+			want: HistVal{t: local("2026-09-01 20:30"), mode: "ctf", nick: "alice", team: 2}},
+		{line: "2026-09-01 20:30\tctf\talice\t2\t17",
+			want: HistVal{t: local("2026-09-01 20:30"), mode: "ctf", nick: "alice", team: 2, id: 17}},
+		{line: "2\t2026-09-01T20:30:00Z\tctf\talice\t1\t17\tacc\tone\t1.2.3.4:27960\tq3dm6\ttrue\twin\tbob\t1200",
+			want: HistVal{v: 2, t: time.Date(2026, 9, 1, 20, 30, 0, 0, time.UTC), mode: "ctf", nick: "alice",
+				team: 1, id: 17, account: "acc", server: "one", host: "1.2.3.4:27960", mapname: "q3dm6",
+				captain: true, result: "win", subfor: "bob", length: 20 * time.Minute}},
+		{line: "2026-09-01 20:30\tctf", bad: true},
+		{line: "yesterday\tctf\talice", bad: true},
+		{line: "2\t2026-09-01T20:30:00Z\tctf\talice", bad: true},
+	} {
+		h, err := parsehist(c.line)
+		switch {
+		case c.bad && err == nil:
+			t.Errorf("%q: parsed", c.line)
+		case !c.bad && err != nil:
+			t.Errorf("%q: %v", c.line, err)
+		case !c.bad && !samehist(h, c.want):
+			t.Errorf("%q: got %+v, want %+v", c.line, h, c.want)
+		}
+		if !c.bad {
+			if s := h.String(); s != c.line {
+				t.Errorf("%q: written as %q", c.line, s)
+			}
+		}
+	}
+}
+
+func samehist(a, b HistVal) bool {
+	return a.t.Equal(b.t) && a.String() == b.String()
+}
+
+func TestHistDB(t *testing.T) {
+	testbot(t)
+	now := time.Now().Truncate(time.Second)
+	game := func(id int, t time.Time, nicks ...string) []HistVal {
+		hs := make([]HistVal, len(nicks))
+		for i, n := range nicks {
+			hs[i] = HistVal{v: histversion, t: t, mode: "ctf", nick: n, team: i%2 + 1, id: id}
+		}
+		return hs
+	}
+	if err := hist.add(game(1, now.Add(-48*time.Hour), "a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := hist.add(game(2, now.Add(-time.Hour), "a", "c")); err != nil {
+		t.Fatal(err)
+	}
+	err := hist.edit(1, func(h *HistVal) bool {
+		if h.nick == "b" {
+			h.nick, h.subfor = "d", "b"
+		}
+		h.result = "draw"
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(when string, db *HistDB) {
+		t.Helper()
+		if n := len(db.recs); n != 4 {
+			t.Errorf("%s: %d entries", when, n)
+		}
+		if n := len(db.player("b")); n != 0 {
+			t.Errorf("%s: b has %d entries", when, n)
+		}
+		if hs := db.player("D"); len(hs) != 1 || hs[0].subfor != "b" || hs[0].result != "draw" {
+			t.Errorf("%s: d has %+v", when, hs)
+		}
+		if n := len(db.player("a")); n != 2 {
+			t.Errorf("%s: a has %d entries", when, n)
+		}
+		if hs := db.since(now.Add(-24 * time.Hour)); len(hs) != 2 || hs[0].id != 2 {
+			t.Errorf("%s: since yesterday %+v", when, hs)
+		}
+		if n := len(db.game(1)); n != 2 {
+			t.Errorf("%s: game 1 has %d entries", when, n)
+		}
+		if id := db.lastid(); id != 2 {
+			t.Errorf("%s: last ID %d", when, id)
+		}
+	}
+	check("edited", hist)
+	db, err := openhist(histdbfile, histfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("reopened", db)
+	if db.dead != 3 {
+		t.Errorf("%d dead records, want 3", db.dead)
+	}
+	if err := db.compact(); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := os.ReadFile(histdbfile)
+	if n := strings.Count(string(b), "\n"); n != 4 || strings.Contains(string(b), "-\t") {
+		t.Errorf("compacted to %d lines:\n%s", n, b)
+	}
+	if db, err = openhist(histdbfile, histfile); err != nil {
+		t.Fatal(err)
+	}
+	check("compacted", db)
+	if err := db.edit(2, func(h *HistVal) bool { return h.nick != "c" }); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(db.player("c")); n != 0 || len(db.game(2)) != 1 {
+		t.Errorf("c has %d entries after being dropped", n)
+	}
+}
+
+// The old log was written in local time, and must still be read so.
+func TestHistMigrate(t *testing.T) {
+	t.Chdir(t.TempDir())
+	loc := time.Local
+	time.Local = time.FixedZone("UTC-4", -4*60*60)
+	t.Cleanup(func() { time.Local = loc })
+	old := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	line := old.Format(tlayout) + "\tctf\talice\t1\t5\n"
+	if err := os.WriteFile(histfile, []byte(line), 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := openhist(histdbfile, histfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db.recs) != 1 || !db.recs[0].t.Equal(old) {
+		t.Fatalf("migrated %+v, want time %v", db.recs, old)
+	}
+	if _, err := os.Stat(histfile + ".old"); err != nil {
+		t.Error(err)
+	}
+	if db, err = openhist(histdbfile, histfile); err != nil || len(db.recs) != 1 || !db.recs[0].t.Equal(old) {
+		t.Errorf("reopened %+v, %v", db.recs, err)
+	}
+}
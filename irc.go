@@ -20,9 +20,12 @@ type IRCconn struct {
 	host      string
 	err       chan error
 	out       chan string
+	quitted   chan struct{} // Closed once QUIT has been written.
 	msgtime   time.Time
 	operators map[string]struct{}
 	oplock    sync.Mutex
+	accounts  map[string]string // Services account by nick.
+	acclock   sync.Mutex
 	conn      net.Conn
 }
 
@@ -132,6 +135,7 @@ func newIRCconn(nick, user, real, pass string) *IRCconn {
 		real:      real,
 		pass:      pass,
 		operators: make(map[string]struct{}),
+		accounts:  make(map[string]string),
 	}
 	return c
 }
@@ -145,12 +149,15 @@ func (c *IRCconn) dial(host string) error {
 	c.host = host
 	c.conn = conn
 	c.out = make(chan string, 64)
+	c.quitted = make(chan struct{})
 	c.err = make(chan error)
 	c.msgtime = time.Now()
 	go c.ping()
 	go c.write()
 	go c.read()
 	log.Println("registering")
+	c.out <- "CAP REQ :account-notify extended-join"
+	c.out <- "CAP END"
 	c.out <- fmt.Sprintf("NICK %s", c.nick)
 	c.out <- fmt.Sprintf("USER %s 0.0.0.0 0.0.0.0 :%s", c.user, c.real)
 	if c.pass != "" {
@@ -181,12 +188,29 @@ func (c *IRCconn) topic(ch, topic string) {
 func (c *IRCconn) join(ch string) {
 	log.Println("joining", ch)
 	c.out <- fmt.Sprintf("JOIN %s", ch)
+	// Ask for everyone's account (WHOX).
+	c.out <- fmt.Sprintf("WHO %s %%na", ch)
 }
 
 func (c *IRCconn) part(ch string) {
 	c.out <- fmt.Sprintf("PART %s", ch)
 }
 
+// Send QUIT after anything already queued, and wait a while for it to
+// be written.
+func (c *IRCconn) quit(msg string) {
+	timeout := time.After(5 * time.Second)
+	select {
+	case c.out <- fmt.Sprintf("QUIT :%s", msg):
+	case <-timeout:
+		return
+	}
+	select {
+	case <-c.quitted:
+	case <-timeout:
+	}
+}
+
 func (c *IRCconn) isopped(who, ch string) bool {
 	c.oplock.Lock()
 	defer c.oplock.Unlock()
@@ -195,6 +219,16 @@ func (c *IRCconn) isopped(who, ch string) bool {
 	return ok
 }
 
+// The services account who is logged in to, or "".
+func (c *IRCconn) account(who string) string {
+	c.acclock.Lock()
+	defer c.acclock.Unlock()
+	if nick, _, _ := splituserstring(who); nick != "" {
+		who = nick
+	}
+	return c.accounts[who]
+}
+
 func (c *IRCconn) ping() {
 	tick := time.Tick(time.Minute)
 	for {
@@ -218,6 +252,10 @@ func (c *IRCconn) write() {
 			c.err <- err
 			break
 		}
+		if strings.HasPrefix(s, "QUIT ") {
+			close(c.quitted)
+			break
+		}
 	}
 }
 
@@ -264,6 +302,7 @@ func (c *IRCconn) read() {
 var num2cmd = map[string]string{
 	"001": "welcome",
 	"353": "rpl_namreply",
+	"354": "rpl_whospcrpl",
 	"366": "rpl_endofnames",
 }
 
@@ -286,14 +325,37 @@ func (c *IRCconn) handle(ev Event) {
 		c.Events <- ev
 	case "rpl_namreply":
 		c.processnames(ev.msg)
+	case "rpl_whospcrpl":
+		// :server 354 me nick account
+		if len(ev.args) >= 3 {
+			c.processaccount(ev.args[1], ev.args[2])
+		}
+	case "account":
+		if len(ev.args) >= 1 {
+			c.processaccount(ev.nick, ev.args[0])
+		}
+	case "join":
+		// With extended-join: JOIN #channel account :realname
+		if len(ev.args) >= 2 {
+			c.processaccount(ev.nick, ev.args[1])
+		}
+		c.Events <- ev
 	case "mode":
 		c.processmode(ev.args)
 	case "nick":
 		c.processnick(ev.nick, ev.msg)
+		c.acclock.Lock()
+		if a, ok := c.accounts[ev.nick]; ok {
+			delete(c.accounts, ev.nick)
+			c.accounts[ev.msg] = a
+		}
+		c.acclock.Unlock()
+		c.Events <- ev
 	case "part":
 		fallthrough
 	case "quit":
 		c.processquit(ev.nick)
+		c.Events <- ev
 	case "ping":
 		c.out <- fmt.Sprintf("PONG :%s", ev.msg)
 	case "version":
@@ -353,6 +415,20 @@ func (c *IRCconn) processnick(who, to string) {
 
 func (c *IRCconn) processquit(who string) {
 	delete(c.operators, who)
+	c.acclock.Lock()
+	delete(c.accounts, who)
+	c.acclock.Unlock()
+}
+
+// Account "*" or "0" means logged out.
+func (c *IRCconn) processaccount(who, account string) {
+	c.acclock.Lock()
+	defer c.acclock.Unlock()
+	if account == "*" || account == "0" {
+		delete(c.accounts, who)
+	} else {
+		c.accounts[who] = account
+	}
 }
 
 // "nick!user@host" to "nick", "user", "host"
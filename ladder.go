@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A challenge to a duel that hasn't been answered yet.
+type Challenge struct {
+	from string // Challenger.
+	to   string // Nick of the challenged player.
+	mode *Mode
+	t    time.Time
+}
+
+// A player's place on a mode's duel ladder.
+type Rung struct {
+	name    string
+	played  time.Time // Last ladder game.
+	decayed int       // Places dropped since then for inactivity.
+}
+
+const (
+	ladderfile       = "pickupladder.log"
+	challengetimeout = 10 * time.Minute    // Unanswered challenges lapse after this long.
+	ladderidle       = 14 * 24 * time.Hour // Players start to drop after this long without a duel.
+	ladderdecay      = 7 * 24 * time.Hour  // Then they drop a place this often.
+	laddershown      = 20                  // Places shown by !ladder.
+)
+
+var (
+	challenges []*Challenge
+	ladders    = make(map[string][]Rung) // Rungs by lower-cased mode name, top first.
+)
+
+// Drop lapsed challenges.
+func prunechallenges() {
+	for i := 0; i < len(challenges); i++ {
+		if time.Since(challenges[i].t) > challengetimeout {
+			challenges = append(challenges[:i], challenges[i+1:]...)
+			i--
+		}
+	}
+}
+
+// The mode for duels when none is given: the first that needs two
+// players.
+func duelmode() *Mode {
+	sorted := make(Modes, 0, len(modes))
+	for _, m := range modes {
+		sorted = append(sorted, m)
+	}
+	sort.Sort(sorted)
+	for _, m := range sorted {
+		if m.nneeded == 2 {
+			return m
+		}
+	}
+	return nil
+}
+
+// Position of name on the ladder of mode, counting from 0, or -1.
+func ladderindex(mode, name string) int {
+	for i, r := range ladders[strings.ToLower(mode)] {
+		if strings.EqualFold(r.name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+func challenge(where, who string, args ...string) bool {
+	if len(args) < 1 || len(args) > 2 {
+		sayusage(where, who, "usage: !challenge nick [mode]")
+		return false
+	}
+	m := duelmode()
+	if len(args) == 2 {
+		m = modes[strings.ToLower(args[1])]
+	}
+	if m == nil {
+		sayusage(where, who, "no such mode")
+		return false
+	}
+	nick, _, _ := splituserstring(who)
+	if strings.EqualFold(nick, args[0]) {
+		sayusage(where, who, "you can't challenge yourself")
+		return false
+	}
+	if findgame(who, "") != nil {
+		sayusage(where, who, "you are already in a game")
+		return false
+	}
+	if checkban(where, who) {
+		return false
+	}
+	prunechallenges()
+	for _, c := range challenges {
+		if c.from == who && strings.EqualFold(c.to, args[0]) {
+			sayusage(where, who, fmt.Sprintf("you have already challenged %s", args[0]))
+			return false
+		}
+	}
+	challenges = append(challenges, &Challenge{who, args[0], m, time.Now()})
+	irc.privmsg(channel, csprintf("{orange}%s{r} challenges {orange}%s{r} to a {orange}{b}%s{b}{r} duel; %s, say {b}!accept{b} or {b}!decline{b}",
+		nick, args[0], m.name, args[0]))
+	return true
+}
+
+// The latest challenge to who, from the player called from if given.
+func findchallenge(who, from string) int {
+	prunechallenges()
+	nick, _, _ := splituserstring(who)
+	for i := len(challenges) - 1; i >= 0; i-- {
+		c := challenges[i]
+		cnick, _, _ := splituserstring(c.from)
+		if strings.EqualFold(c.to, nick) && (from == "" || strings.EqualFold(cnick, from)) {
+			return i
+		}
+	}
+	return -1
+}
+
+func accept(where, who string, args ...string) bool {
+	if len(args) > 1 {
+		sayusage(where, who, "usage: !accept [nick]")
+		return false
+	}
+	from := ""
+	if len(args) == 1 {
+		from = args[0]
+	}
+	i := findchallenge(who, from)
+	if i < 0 {
+		sayusage(where, who, "no one has challenged you")
+		return false
+	}
+	c := challenges[i]
+	if findgame(who, "") != nil || findgame(c.from, "") != nil {
+		sayusage(where, who, "one of you is already in a game")
+		return false
+	}
+	if checkban(where, who) {
+		return false
+	}
+	challenges = append(challenges[:i], challenges[i+1:]...)
+	c.mode.updateservers()
+	players := []Player{{user: c.from}, {user: who}}
+	g := newgame(c.mode, players)
+	g.ladder = true
+	g.teamnames = []string{c.mode.teamname(1), c.mode.teamname(2)}
+	g.setteams([][]Player{players[:1], players[1:]})
+	g.start()
+	return true
+}
+
+func decline(where, who string, args ...string) bool {
+	if len(args) > 1 {
+		sayusage(where, who, "usage: !decline [nick]")
+		return false
+	}
+	from := ""
+	if len(args) == 1 {
+		from = args[0]
+	}
+	i := findchallenge(who, from)
+	if i < 0 {
+		sayusage(where, who, "no one has challenged you")
+		return false
+	}
+	c := challenges[i]
+	challenges = append(challenges[:i], challenges[i+1:]...)
+	nick, _, _ := splituserstring(who)
+	cnick, _, _ := splituserstring(c.from)
+	irc.privmsg(channel, csprintf("{orange}%s{r} declines {orange}%s{r}'s challenge", nick, cnick))
+	return true
+}
+
+// Put the players of ladder game g on its ladder if they are new to it,
+// and give the winner the loser's place if it was higher.
+func ladderresult(g *Game, winner int) {
+	k := strings.ToLower(g.name)
+	now := time.Now()
+	for _, name := range []string{g.names(1)[0], g.names(2)[0]} {
+		i := ladderindex(g.name, name)
+		if i < 0 {
+			ladders[k] = append(ladders[k], Rung{name: name})
+			i = len(ladders[k]) - 1
+		}
+		ladders[k][i].played = now
+		ladders[k][i].decayed = 0
+	}
+	if winner != 0 {
+		w := ladderindex(g.name, g.names(winner)[0])
+		l := ladderindex(g.name, g.names(3 - winner)[0])
+		if w > l {
+			ladders[k][w], ladders[k][l] = ladders[k][l], ladders[k][w]
+			irc.privmsg(channel, csprintf("{orange}%s{r} takes {orange}%s{r}'s place at {b}#%d{b} on the {orange}{b}%s{b}{r} ladder",
+				ladders[k][l].name, ladders[k][w].name, l+1, g.name))
+		}
+	}
+	writeladders(ladderfile)
+}
+
+// Drop players who haven't duelled in ladderidle a place, then another
+// place every ladderdecay until they duel again. The players due to drop
+// are taken out first and put back top-down in the places they are due,
+// so that they drop past active players rather than past each other.
+func decayladders() {
+	type drop struct {
+		r  Rung
+		to int // Place due.
+	}
+	changed := false
+	for k, rs := range ladders {
+		var drops []drop
+		kept := make([]Rung, 0, len(rs))
+		for i, r := range rs {
+			idle := time.Since(r.played)
+			want := int((idle-ladderidle)/ladderdecay) + 1
+			if idle < ladderidle || r.decayed >= want {
+				kept = append(kept, r)
+				continue
+			}
+			drops = append(drops, drop{r, i + want - r.decayed})
+			drops[len(drops)-1].r.decayed = want
+		}
+		if len(drops) == 0 {
+			continue
+		}
+		sort.SliceStable(drops, func(i, j int) bool { return drops[i].to < drops[j].to })
+		last := -1
+		for _, d := range drops {
+			to := d.to
+			if to <= last {
+				to = last + 1 // Due the same place as the one above.
+			}
+			if to > len(kept) {
+				to = len(kept)
+			}
+			kept = append(kept[:to], append([]Rung{d.r}, kept[to:]...)...)
+			last = to
+		}
+		ladders[k] = kept
+		changed = true
+	}
+	if changed {
+		writeladders(ladderfile)
+	}
+}
+
+func showladder(where, who string, args ...string) bool {
+	if len(args) > 1 {
+		sayusage(where, who, "usage: !ladder [mode]")
+		return false
+	}
+	m := duelmode()
+	if len(args) == 1 {
+		m = modes[strings.ToLower(args[0])]
+	}
+	if m == nil {
+		sayusage(where, who, "no such mode")
+		return false
+	}
+	rs := ladders[strings.ToLower(m.name)]
+	if len(rs) == 0 {
+		say(where, who, fmt.Sprintf("the %s ladder is empty", m.name))
+		return true
+	}
+	if len(rs) > laddershown {
+		rs = rs[:laddershown]
+	}
+	ss := make([]string, len(rs))
+	for i, r := range rs {
+		ss[i] = fmt.Sprintf("%d. %s", i+1, r.name)
+	}
+	say(where, who, fmt.Sprintf("%s ladder: %s", m.name, strings.Join(ss, " ")))
+	return true
+}
+
+func readladders(fname string) error {
+	f, err := os.OpenFile(fname, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewScanner(f)
+	for r.Scan() {
+		ss := strings.Split(r.Text(), "\t")
+		if len(ss) != 4 {
+			log.Println("bad entry in ladder")
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, ss[2])
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		n, _ := strconv.Atoi(ss[3])
+		k := strings.ToLower(ss[0])
+		ladders[k] = append(ladders[k], Rung{ss[1], t, n})
+	}
+	return r.Err()
+}
+
+// Rewrite the ladder file, top of each ladder first.
+func writeladders(fname string) {
+	err := writeatomic(fname, func(w *bufio.Writer) error {
+		for k, rs := range ladders {
+			for _, r := range rs {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", k, r.name, r.played.Format(time.RFC3339), r.decayed)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
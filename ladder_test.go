@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecayladders(t *testing.T) {
+	for _, c := range []struct {
+		idle string // Each player's idle weeks, top first, a to z.
+		want string
+	}{
+		{"0000", "abcd"},
+		{"2000", "bacd"},
+		{"3000", "bcad"},
+		{"0002", "abcd"},
+		{"2200", "cabd"},
+		{"2020", "badc"},
+		{"4200", "cdba"},
+		{"3300", "cdab"},
+		{"2222", "abcd"},
+	} {
+		testbot(t)
+		now := time.Now()
+		var rs []Rung
+		for i, w := range c.idle {
+			weeks := time.Duration(w-'0') * 7 * 24 * time.Hour
+			rs = append(rs, Rung{name: string(rune('a' + i)), played: now.Add(-weeks - time.Hour)})
+		}
+		ladders = map[string][]Rung{"duel": rs}
+		decayladders()
+		decayladders() // Nothing more is due.
+		var got strings.Builder
+		for _, r := range ladders["duel"] {
+			got.WriteString(r.name)
+		}
+		if got.String() != c.want {
+			t.Errorf("idle %s: ladder %s, want %s", c.idle, got.String(), c.want)
+		}
+	}
+}
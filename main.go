@@ -6,12 +6,15 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"math/rand"
 	"os"
+	"os/signal"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
+	"unicode"
 )
 
 type Client struct {
@@ -26,6 +29,8 @@ type Server interface {
 	alias() string
 	hostname() string // e.g. "#CPMPICKUP #1 - Roboty Arena"
 	host() string     // e.g. "cpmpickup.de"
+	kind() string     // Game it was added for, e.g. "cpm"
+	addr() string     // Host and query port, e.g. "cpmpickup.de:27960"
 	port() string
 	password() string
 	clients() Clients
@@ -41,25 +46,53 @@ type Server interface {
 
 type Mode struct {
 	name       string
-	srvs       []Server // Server pool.
-	srv        Server   // Last chosen server.
-	who        []Player // Players added.
-	nneeded    int      // Players needed.
-	cap1, cap2 string   // Captains.
+	srvs       []Server      // Server pool.
+	srv        Server        // Last chosen server.
+	who        []Player      // Players added.
+	nneeded    int           // Players needed.
+	pickorder  string        // Captains' pick order, e.g. "abba".
+	pickmethod string        // How teams are picked: captains, random or balance.
+	expire     time.Duration // Default expiry time, if not defaultexpire.
+	maxexpire  time.Duration // Longest expiry time allowed, or 0.
+	priority   int           // Modes that fill together start highest first.
+	maps       []string      // Map pool to vote on.
+	teams      int           // Number of teams, or 0 to guess from the name.
+	teamsize   int           // Players per team, or 0 if set by !mode.
+	teamnames  []string      // Team names, or nil for the defaults.
+	promoteat  int           // Players at which to promote the mode, or 0.
+	promoted   time.Time     // Last promotion.
 }
 
 type Modes []*Mode // sort.Interface
 
 // An !added user.
 type Player struct {
-	user   string    // user@host
-	expire time.Time // Expiry time.
+	user    string    // user@host
+	expire  time.Time // Expiry time.
+	captain bool      // Volunteered to captain.
+	warned  bool      // Warned that expiry is near.
+	added   time.Time // When they added, for queue order.
+	team    int       // 1 or 2 once teams are picked, else 0.
 }
 
+// A player's entry in the history of a game.
 type HistVal struct {
+	v    int // Format version: 0 for old entries, or histversion.
 	t    time.Time
 	mode string
 	nick string
+	team int // 0 if the game had no teams.
+	id   int // Game ID, or 0 for old entries.
+
+	// Since version 2.
+	account string        // Services account, if logged in.
+	server  string        // Server alias.
+	host    string        // Server host:port.
+	mapname string        // Map, if chosen from the mode's pool.
+	captain bool          // Captained their team?
+	result  string        // "win", "loss" or "draw" once reported.
+	subfor  string        // Player they came in for, if a sub.
+	length  time.Duration // Time from the start to the result.
 }
 
 type Top10Val struct {
@@ -71,15 +104,16 @@ type Top10 []Top10Val // sort.Interface
 
 type Botfn struct {
 	fn   func(string, string, ...string) (ok bool) // The command.
-	save bool                                      // Save to pickup.rc?
+	save bool                                      // Rewrite the config file?
 	op   bool                                      // Operators only?
 }
 
 const (
-	runcommands   = "pickup.rc"
-	histfile      = "pickuphistory.log"
+	runcommands   = "pickup.rc"         // Operator commands, replaced by configfile.
+	histfile      = "pickuphistory.log" // Game history, replaced by histdbfile.
 	tlayout       = "2006-01-02 15:04"
 	defaultexpire = "3h"
+	expirewarn    = 5 * time.Minute // Warn players this long before they expire.
 )
 
 const ErrPermission = "only ops may use that command"
@@ -91,6 +125,7 @@ var (
 	vol       = flag.Int("v", 2, "intrusiveness of command responses; 1=message user, 2=notice user, 3=message channel, 4=notice channel")
 	ccflag    = flag.String("cc", "", "other channels to send !promote and !sub messages to, comma-separated")
 	ccto      []string
+	tzflag    = flag.String("tz", "", "time zone for times shown in the channel, e.g. Europe/London; default is local time")
 	host      string
 	channel   string
 	modes     = make(map[string]*Mode)
@@ -99,39 +134,80 @@ var (
 	teamspeak string
 	voip      string
 	irc       *IRCconn
-	lastgame  *Mode
 	initial   = true
 	version   = "pkup"
 )
 
 var botcmds = map[string]Botfn{
-	"add":       {add, false, false},
-	"addserver": {addserver, true, true},
-	"delmode":   {delmode, true, true},
-	"delserver": {delserver, true, true},
-	"expire":    {setexpire, false, false},
-	"help":      {help, false, false},
-	"lastgame":  {showlastgame, false, false},
-	"list":      {listservers, false, false},
-	"mode":      {addmode, true, true},
-	"modes":     {listmodes, false, false},
-	"month":     {top10month, false, false},
-	"motd":      {setmotd, true, true},
-	"mumble":    {querymumble, false, false},
-	"promote":   {promote, false, false},
-	"q":         {serverinfo, false, false},
-	"remove":    {remove, false, false},
-	"setmumble": {setmumble, true, true},
-	"setts":     {setts, true, true},
-	"setvoip":   {setvoip, true, true},
-	"top":       {topmost, false, false},
-	"top10":     {top10players, false, false},
-	"top25":     {top25players, false, false},
-	"ts":        {queryts, false, false},
-	"version":   {showversion, false, false},
-	"voip":      {queryvoip, false, false},
-	"week":      {top10week, false, false},
-	"who":       {listplayers, false, false},
+	"abort":        {abort, false, false},
+	"accept":       {accept, false, false},
+	"add":          {add, false, false},
+	"alias":        {alias, false, false},
+	"addserver":    {addserver, true, true},
+	"captain":      {captain, false, false},
+	"challenge":    {challenge, false, false},
+	"cup":          {cup, false, false},
+	"decline":      {decline, false, false},
+	"delmode":      {delmode, true, true},
+	"delserver":    {delserver, true, true},
+	"expire":       {setexpire, false, false},
+	"export":       {export, false, true},
+	"game":         {showgame, false, false},
+	"games":        {listgames, false, false},
+	"help":         {help, false, false},
+	"history":      {showhistory, false, false},
+	"ladder":       {showladder, false, false},
+	"lastgame":     {showlastgame, false, false},
+	"leaderboard":  {leaderboard, false, false},
+	"list":         {listservers, false, false},
+	"mappool":      {mappool, true, true},
+	"maps":         {showmaps, false, false},
+	"mode":         {addmode, true, true},
+	"modeexpire":   {setmodeexpire, true, true},
+	"modepriority": {setmodepriority, true, true},
+	"modeset":      {modeset, true, true},
+	"modes":        {listmodes, false, false},
+	"month":        {topof("modes", "month"), false, false},
+	"motd":         {setmotd, true, true},
+	"mumble":       {querymumble, false, false},
+	"needsub":      {needsub, false, false},
+	"noshow":       {noshow, false, true},
+	"pban":         {pban, false, true},
+	"pbans":        {listbans, false, true},
+	"pick":         {pick, false, false},
+	"pickmethod":   {setpickmethod, true, true},
+	"pickorder":    {setpickorder, true, true},
+	"promote":      {promote, false, false},
+	"punban":       {punban, false, true},
+	"q":            {serverinfo, false, false},
+	"reload":       {reload, false, true},
+	"rating":       {showrating, false, false},
+	"remove":       {remove, false, false},
+	"reminders":    {setreminders, true, true},
+	"report":       {report, false, false},
+	"schedule":     {schedule, false, false},
+	"seen":         {showseen, false, false},
+	"setmumble":    {setmumble, true, true},
+	"setrating":    {setrating, false, true},
+	"setts":        {setts, true, true},
+	"setvoip":      {setvoip, true, true},
+	"signup":       {signup, false, false},
+	"stats":        {stats, false, false},
+	"sub":          {sub, false, false},
+	"subscribe":    {subscribe, false, false},
+	"timezone":     {settimezone, false, false},
+	"top":          {top, false, false},
+	"top10":        {topof("players", "week"), false, false},
+	"top25":        {topof("players", "month", "25"), false, false},
+	"ts":           {queryts, false, false},
+	"unschedule":   {unschedule, false, true},
+	"unsignup":     {unsignup, false, false},
+	"unsubscribe":  {unsubscribe, false, false},
+	"version":      {showversion, false, false},
+	"vote":         {vote, false, false},
+	"voip":         {queryvoip, false, false},
+	"week":         {topof("modes", "week"), false, false},
+	"who":          {listplayers, false, false},
 }
 
 func say(where, who, what string) {
@@ -181,15 +257,158 @@ func addmode(where, who string, args ...string) bool {
 		modes[k] = &Mode{name: args[0]}
 	}
 	modes[k].nneeded = n
+	modes[k].teamsize = 0
 	if !initial {
 		updatetopic()
-		if len(modes[k].who) >= modes[k].nneeded {
-			modes[k].startgame()
+		startfull()
+	}
+	return true
+}
+
+// Attributes settable with !modeset.
+var modeattrs = []string{"teams", "size", "names", "pick", "order", "expire", "maxexpire", "priority", "promote"}
+
+// Set a mode's attributes from attribute and value pairs, checking them
+// all before changing any.
+func modeset(where, who string, args ...string) bool {
+	fail := func(s string) bool {
+		if initial {
+			log.Println(s)
+		} else {
+			sayusage(where, who, s)
 		}
+		return false
+	}
+	if len(args) < 3 || len(args)%2 == 0 {
+		return fail("usage: !modeset mode attribute value ... (" + strings.Join(modeattrs, ", ") + ")")
+	}
+	m, ok := modes[strings.ToLower(args[0])]
+	if !ok {
+		return fail(fmt.Sprintf("%s: no such mode", args[0]))
+	}
+	c := m.clone()
+	for i := 1; i < len(args); i += 2 {
+		if err := c.setattr(strings.ToLower(args[i]), args[i+1]); err != nil {
+			return fail(fmt.Sprintf("error: %s: %v", args[i], err))
+		}
+	}
+	if c.teamsize > 0 {
+		c.nneeded = c.teamsize * c.nteams()
+	}
+	*m = *c
+	if !initial {
+		say(where, who, m.attrstring())
+		updatetopic()
+		startfull()
 	}
 	return true
 }
 
+func (m *Mode) setattr(k, v string) error {
+	switch k {
+	case "promote":
+		// "6" or "6/8"
+		n, err := strconv.Atoi(strings.SplitN(v, "/", 2)[0])
+		if err != nil || n < 0 {
+			return errors.New("not a number of players")
+		}
+		m.promoteat = n
+	case "teams", "size", "priority":
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return errors.New("not a number")
+		}
+		switch {
+		case k == "priority":
+			m.priority = n
+		case k == "size" && n >= 0:
+			m.teamsize = n
+		case k == "teams" && n >= 0 && n <= maxteams:
+			m.teams = n
+		default:
+			return errors.New("out of range")
+		}
+	case "names":
+		m.teamnames = nil
+		if strings.ToLower(v) == "default" {
+			break
+		}
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				return errors.New("empty team name")
+			}
+			m.teamnames = append(m.teamnames, name)
+		}
+	case "pick":
+		v = strings.ToLower(v)
+		for _, pm := range pickmethods {
+			if v == pm {
+				m.pickmethod = v
+				return nil
+			}
+		}
+		return errors.New("must be one of " + strings.Join(pickmethods, ", "))
+	case "order":
+		if !validpickorder(v) {
+			return errors.New("must be a pattern of a, b, c... or alternate or snake")
+		}
+		m.pickorder = strings.ToLower(v)
+	case "expire", "maxexpire":
+		d, err := parseduration(v)
+		if err != nil || d < 0 {
+			return errors.New("bad duration")
+		}
+		if k == "expire" {
+			m.expire = d
+		} else {
+			m.maxexpire = d
+		}
+	default:
+		return errors.New("no such attribute")
+	}
+	return nil
+}
+
+// The mode's attributes as !modeset arguments.
+func (m *Mode) attrstring() string {
+	names := make([]string, m.nteams())
+	for i := range names {
+		names[i] = m.teamname(i + 1)
+	}
+	pick := m.pickmethod
+	if pick == "" {
+		pick = "captains"
+	}
+	order := m.pickorder
+	if order == "" {
+		order = "alternate"
+	}
+	expire := m.expire
+	if expire == 0 {
+		expire, _ = time.ParseDuration(defaultexpire)
+	}
+	return fmt.Sprintf("%s: players %d teams %d size %d names %s pick %s order %s expire %v maxexpire %v priority %d promote %d",
+		m.name, m.nneeded, m.nteams(), m.teamsize, strings.Join(names, ","),
+		pick, order, expire, m.maxexpire, m.priority, m.promoteat)
+}
+
+func setmodeexpire(where, who string, args ...string) bool {
+	if len(args) < 2 || len(args) > 3 {
+		usage := "usage: !modeexpire mode default [max]"
+		if initial {
+			log.Println(usage)
+		} else {
+			sayusage(where, who, usage)
+		}
+		return false
+	}
+	max := "0"
+	if len(args) == 3 {
+		max = args[2]
+	}
+	return modeset(where, who, args[0], "expire", args[1], "maxexpire", max)
+}
+
 func delmode(where, who string, args ...string) bool {
 	if len(args) != 1 {
 		sayusage(where, who, "usage: !delmode name")
@@ -197,7 +416,9 @@ func delmode(where, who string, args ...string) bool {
 	}
 	k := strings.ToLower(args[0])
 	delete(modes, k)
-	updatetopic()
+	if !initial {
+		updatetopic()
+	}
 	return true
 }
 
@@ -272,21 +493,22 @@ Search:
 }
 
 func add(where, who string, args ...string) bool {
+	if checkban(where, who) {
+		return false
+	}
 	update := false
+	now := time.Now()
 	defer func() {
 		if update {
 			updatetopic()
+			noteadd(who)
 		}
-		for _, m := range modes {
-			if len(m.who) >= m.nneeded {
-				m.startgame()
-				break
-			}
-		}
+		startfull()
+		autopromote()
 	}()
 	if len(args) < 1 {
 		for _, m := range modes {
-			u := m.addplayer(who)
+			u := m.addplayer(who, now)
 			update = u || update
 			m.srv = nil
 		}
@@ -298,7 +520,7 @@ func add(where, who string, args ...string) bool {
 		if mname[0] == '-' && len(mname) > 1 {
 			for k, m := range modes {
 				if k != mname[1:] {
-					u := m.addplayer(who)
+					u := m.addplayer(who, now)
 					update = u || update
 				} else {
 					u := m.removeplayer(who)
@@ -313,7 +535,7 @@ func add(where, who string, args ...string) bool {
 			say(where, who, fmt.Sprintf("%s: no such mode", mname))
 			return false
 		}
-		u := m.addplayer(who)
+		u := m.addplayer(who, now)
 		update = u || update
 		m.srv = nil
 	}
@@ -345,26 +567,68 @@ func remove(where, who string, args ...string) bool {
 	return true
 }
 
+// Set who's expiry time in the given modes, or in every mode they are
+// added to. With no arguments, show the time left in each mode.
 func setexpire(where, who string, args ...string) bool {
 	if len(args) < 1 {
-		sayusage(where, who, "usage: !expire 1m30s")
-		return false
+		return showexpire(where, who)
 	}
 
 	now := time.Now()
-	expire, err := time.ParseDuration(args[0])
-	if err != nil {
-		sayusage(where, who, "error: bad time string")
+	expire, err := parseduration(args[0])
+	if err != nil || expire <= 0 {
+		sayusage(where, who, "usage: !expire 1h30m [mode] ...")
 		return false
 	}
 
-	for i, m := range modes {
-		for j, u := range m.who {
-			if u.user == who {
-				modes[i].who[j].expire = now.Add(expire)
-			}
+	ms := make([]*Mode, 0, len(modes))
+	if len(args) < 2 {
+		for _, m := range modes {
+			ms = append(ms, m)
 		}
 	}
+	for _, mname := range args[1:] {
+		m, ok := modes[strings.ToLower(mname)]
+		if !ok {
+			sayusage(where, who, fmt.Sprintf("%s: no such mode", mname))
+			return false
+		}
+		ms = append(ms, m)
+	}
+	var capped []string
+	for _, m := range ms {
+		i := findplayer(m.who, who)
+		if i < 0 {
+			continue
+		}
+		d := expire
+		if m.maxexpire > 0 && d > m.maxexpire {
+			d = m.maxexpire
+			capped = append(capped, fmt.Sprintf("%s to %v", m.name, d))
+		}
+		m.who[i].expire = now.Add(d)
+		m.who[i].warned = false
+	}
+	if len(capped) > 0 {
+		say(where, who, "expiry capped in "+strings.Join(capped, ", "))
+	}
+	return true
+}
+
+func showexpire(where, who string) bool {
+	var ss []string
+	for _, m := range modes {
+		if i := findplayer(m.who, who); i >= 0 {
+			left := time.Until(m.who[i].expire).Round(time.Minute)
+			ss = append(ss, fmt.Sprintf("%s %v", m.name, left))
+		}
+	}
+	if len(ss) == 0 {
+		say(where, who, "you aren't added to any modes")
+		return true
+	}
+	sort.Strings(ss)
+	say(where, who, "time left: "+strings.Join(ss, ", "))
 	return true
 }
 
@@ -396,16 +660,9 @@ func setvoip(where, who string, args ...string) bool {
 }
 
 func listplayers(where, who string, args ...string) bool {
-	who, _, _ = splituserstring(who)
 	if len(args) < 1 {
 		for _, m := range modes {
-			nicks := ""
-			for _, u := range m.who {
-				nick, _, _ := splituserstring(u.user)
-				nicks += nick + " "
-			}
-			nicks = strings.Trim(nicks, " ")
-			if nicks != "" {
+			if nicks := m.nicksstring(); nicks != "" {
 				say(where, who, fmt.Sprintf("%s: %s", m.name, nicks))
 			}
 		}
@@ -417,17 +674,25 @@ func listplayers(where, who string, args ...string) bool {
 			say(where, who, fmt.Sprintf("%s: no such mode", mname))
 			return false
 		}
-		nicks := ""
-		for _, u := range m.who {
-			nick, _, _ := splituserstring(u.user)
-			nicks += nick + " "
-		}
-		nicks = strings.Trim(nicks, " ")
-		say(where, who, fmt.Sprintf("%s: %s", m.name, nicks))
+		say(where, who, fmt.Sprintf("%s: %s", m.name, m.nicksstring()))
 	}
 	return true
 }
 
+// Players added to m in queue order, with any beyond the next game's
+// set apart.
+func (m *Mode) nicksstring() string {
+	nicks := make([]string, len(m.who))
+	for i, u := range m.who {
+		nicks[i], _, _ = splituserstring(u.user)
+	}
+	if m.nneeded > 0 && len(nicks) > m.nneeded {
+		return strings.Join(nicks[:m.nneeded], " ") + " | next: " +
+			strings.Join(nicks[m.nneeded:], " ")
+	}
+	return strings.Join(nicks, " ")
+}
+
 func serverinfo(where, who string, args ...string) bool {
 	if len(args) != 1 {
 		sayusage(where, who, "usage: !q alias")
@@ -468,22 +733,49 @@ Look:
 
 func help(where, who string, args ...string) bool {
 	cmds := []string{
+		"abort",
+		"accept",
 		"add",
+		"alias",
+		"captain",
+		"challenge",
+		"cup",
+		"decline",
 		"expire",
+		"game",
+		"games",
 		"help",
+		"history",
+		"ladder",
 		"lastgame",
+		"leaderboard",
 		"list",
+		"maps",
 		"modes",
 		"month",
 		"mumble",
+		"needsub",
+		"pick",
 		"promote",
 		"q",
+		"rating",
 		"remove",
+		"report",
+		"schedule",
+		"seen",
+		"signup",
+		"stats",
+		"sub",
+		"subscribe",
+		"timezone",
 		"ts",
 		"top",
 		"top10",
 		"top25",
+		"unsignup",
+		"unsubscribe",
 		"version",
+		"vote",
 		"week",
 		"who",
 	}
@@ -491,11 +783,26 @@ func help(where, who string, args ...string) bool {
 		"addserver",
 		"delmode",
 		"delserver",
+		"export",
+		"mappool",
 		"mode",
+		"modeexpire",
+		"modepriority",
+		"modeset",
 		"motd",
+		"noshow",
+		"pban",
+		"pbans",
+		"pickmethod",
+		"pickorder",
+		"punban",
+		"reload",
+		"reminders",
 		"setmumble",
+		"setrating",
 		"setts",
 		"setvoip",
+		"unschedule",
 	}
 	s := "commands:"
 	for i := range cmds {
@@ -512,70 +819,54 @@ func help(where, who string, args ...string) bool {
 	return true
 }
 
-func showlastgame(where, who string, args ...string) bool {
-	if lastgame == nil {
-		say(where, who, "none")
-		return false
+// Write fname with write, replacing it only once it is complete.
+func writeatomic(fname string, write func(w *bufio.Writer) error) error {
+	f, err := os.Create(fname + ".tmp")
+	if err != nil {
+		return err
 	}
-	m := lastgame
-	nicks := make([]string, 0)
-	for _, u := range m.who {
-		nick, _, _ := splituserstring(u.user)
-		nicks = append(nicks, nick)
+	w := bufio.NewWriter(f)
+	if err := write(w); err != nil {
+		f.Close()
+		os.Remove(fname + ".tmp")
+		return err
 	}
-	nicksstr := strings.Join(nicks, " ")
-	srvstr := ""
-	captainsstr := ""
-	if m.srv == nil {
-		srvstr = Violet + "but there are no online servers in its pool =["
-	} else {
-		host := fmt.Sprintf("%s:%s", m.srv.host(), m.srv.port())
-		if m.srv.password() != "" {
-			srvstr = csprintf("{pink}{b}connect %s;password %s",
-				host, m.srv.password())
-		} else {
-			srvstr = csprintf("{pink}{b}connect %s", host)
-		}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(fname + ".tmp")
+		return err
 	}
-	if m.teamgame() && len(m.who) >= 2 {
-		captainsstr = csprintf("{r} || team captains are {red}%s{r} and {blue}%s{r}",
-			m.cap1, m.cap2)
+	if err := f.Close(); err != nil {
+		return err
 	}
-	s := csprintf("{orange}{b}%s{b} is ready {r}-> %s {r}<- {orange}%s%s",
-		m.name, srvstr, nicksstr, captainsstr)
-	say(where, who, s)
-	return true
+	return os.Rename(fname+".tmp", fname)
 }
 
-func promote(where, who string, args ...string) bool {
-	var m *Mode
-	if len(args) > 0 {
-		m = modes[strings.ToLower(args[0])]
-		if m == nil {
-			sayusage(where, who, fmt.Sprintf("%s: no such mode", args[0]))
-			return false
-		}
-	} else {
-		for _, mm := range modes {
-			if m == nil || len(mm.who) > len(m.who) {
-				m = mm
-			}
-		}
-	}
-	if len(m.who) >= m.nneeded {
-		return false
-	}
+// Notice the channel and the -cc channels.
+func broadcast(s string) {
 	cc := append([]string{channel}, ccto...)
 	for i := range cc {
-		s := csprintf("{pink}Please !add for {b}%s{b} {cyan}[%d/%d]{pink} in {b}%s{b}!",
-			m.name, len(m.who), m.nneeded, channel)
+		if cc[i] == "" {
+			continue
+		}
 		irc.notice(cc[i], s)
 		time.Sleep(60 * time.Millisecond)
 	}
-	return true
 }
 
 func listmodes(where, who string, args ...string) bool {
+	if len(args) > 0 {
+		for _, a := range args {
+			m, ok := modes[strings.ToLower(a)]
+			if !ok {
+				sayusage(where, who, fmt.Sprintf("%s: no such mode", a))
+				return false
+			}
+			say(where, who, m.attrstring())
+			time.Sleep(60 * time.Millisecond)
+		}
+		return true
+	}
 	s := ""
 	for k, _ := range modes {
 		s += " " + k
@@ -609,7 +900,9 @@ func setmotd(where, who string, args ...string) bool {
 	for _, s := range args {
 		motd += s + " "
 	}
-	updatetopic()
+	if !initial {
+		updatetopic()
+	}
 	return true
 }
 
@@ -648,6 +941,9 @@ func updatetopic() {
 		s := csprintf("{red}{b}%s{b} {dkred}[%d/%d]{r}", m.name, len(m.who), m.nneeded)
 		ms = append(ms, s)
 	}
+	if s := nexteventstring(); s != "" {
+		ms = append(ms, "next: "+s)
+	}
 	if motd != "" {
 		ms = append(ms, motd)
 	}
@@ -659,7 +955,7 @@ func updatetopic() {
 func newserver(game, alias, host, pass string) (Server, error) {
 	switch game {
 	case "q3", "quake", "cpm", "cpma", "wsw", "warsow":
-		return newqserver(alias, host, pass), nil
+		return newqserver(game, alias, host, pass), nil
 	case "reflex":
 		return newreflexserver(alias, host, pass), nil
 	default:
@@ -676,32 +972,77 @@ func (m *Mode) clone() *Mode {
 	c := *m
 	c.srvs = make([]Server, len(m.srvs))
 	c.who = make([]Player, len(m.who))
+	c.maps = make([]string, len(m.maps))
+	c.teamnames = make([]string, len(m.teamnames))
+	copy(c.maps, m.maps)
+	copy(c.teamnames, m.teamnames)
 	copy(c.srvs, m.srvs)
 	copy(c.who, m.who)
 	return &c
 }
 
 func (m *Mode) teamgame() bool {
-	ms := []string{"tdm", "ctf", "ntf", "ca", "3v3", "bomb"}
-	s := strings.ToLower(m.name)
-	for i := range ms {
-		if strings.Contains(s, ms[i]) {
-			return true
+	return m.nteams() >= 2
+}
+
+// Team modes by name, for modes without a teams attribute: a word of
+// the name is a team gametype, optionally numbered, or like "2v2",
+// unless another word makes it a duel, as in "duel_ca_practice".
+var (
+	teammodename = regexp.MustCompile(`^((tdm|ctf|ntf|ca|bomb)[0-9]*|([2-9]|[1-9][0-9]+)v[0-9]+)$`)
+	duelmodename = regexp.MustCompile(`^(duel|1v1)$`)
+)
+
+// The number of teams, guessed from the name unless set with !modeset.
+func (m *Mode) nteams() int {
+	if m.teams > 0 {
+		return m.teams
+	}
+	words := strings.FieldsFunc(strings.ToLower(m.name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, w := range words {
+		if duelmodename.MatchString(w) {
+			return 1
 		}
 	}
-	return false
+	for _, w := range words {
+		if teammodename.MatchString(w) {
+			return 2
+		}
+	}
+	return 1
+}
+
+// The name of team t, counting from 1.
+func (m *Mode) teamname(t int) string {
+	if t <= len(m.teamnames) {
+		return m.teamnames[t-1]
+	}
+	if t <= len(defaultteamnames) {
+		return defaultteamnames[t-1]
+	}
+	return fmt.Sprintf("Team%d", t)
 }
 
-func (m *Mode) addplayer(who string) bool {
+// Add who to m at now. Every mode an !add adds to is given the same
+// time, so that the order of their queues doesn't depend on the order
+// they were added in.
+func (m *Mode) addplayer(who string, now time.Time) bool {
 	// Already added?
 	for _, u := range m.who {
 		if u.user == who {
 			return false
 		}
 	}
-	now := time.Now()
-	expire, _ := time.ParseDuration(defaultexpire)
-	m.who = append(m.who, Player{who, now.Add(expire)})
+	expire := m.expire
+	if expire == 0 {
+		expire, _ = time.ParseDuration(defaultexpire)
+	}
+	if m.maxexpire > 0 && expire > m.maxexpire {
+		expire = m.maxexpire
+	}
+	m.who = append(m.who, Player{user: who, expire: now.Add(expire), added: now})
 	return true
 }
 
@@ -718,20 +1059,52 @@ func (m *Mode) removeplayer(who string) bool {
 	return removed
 }
 
+// Start a game with the first nneeded players and take them out of
+// every mode, then either hold a captains' draft or announce the game
+// straight away. Any other players stay queued for the next game.
 func (m *Mode) startgame() {
+	n := len(m.who)
+	if m.nneeded > 0 && n > m.nneeded {
+		n = m.nneeded
+	}
 	m.updateservers()
-	m.pickcaptains()
-	m.promotestarting()
-	who := make([]Player, len(m.who))
-	copy(who, m.who)
-	loggamestart(m.name, who)
-	lastgame = m.clone()
+	newgame(m, m.who[:n]).start()
+}
+
+// Take g's players out of every mode, choose its map and, unless they
+// are already set, pick its teams.
+func (g *Game) start() {
+	m := g.mode
 	for _, m := range modes {
-		for _, u := range who {
+		for _, u := range g.who {
 			m.removeplayer(u.user)
 		}
 	}
-	m.who = []Player{}
+	g.choosemap()
+	switch {
+	case !g.teamgame() || g.caps != nil:
+		g.launch()
+	case len(g.who) == len(g.teamnames):
+		// One player a team: there is no one to pick or balance.
+		g.setteams(randomteams(g.who, len(g.teamnames)))
+		g.launch()
+	case m.pickmethod == "random":
+		g.setteams(randomteams(g.who, len(g.teamnames)))
+		g.launch()
+	case m.pickmethod == "balance":
+		g.setteams(balance(g.name, g.who, len(g.teamnames)))
+		avgs := make([]string, len(g.teamnames))
+		for t := range avgs {
+			avgs[t] = teamcolour(t+1, fmt.Sprintf("%.0f", g.avgrating(t+1)))
+		}
+		s := csprintf("{orange}{b}%s{b} #%d{r} teams balanced: %s average rating",
+			g.name, g.id, strings.Join(avgs, " vs "))
+		irc.privmsg(channel, s)
+		g.launch()
+	default:
+		g.pickcaptains()
+		newdraft(g).start()
+	}
 	go func() {
 		time.Sleep(5 * time.Second)
 		updatetopic()
@@ -761,63 +1134,6 @@ func (m *Mode) updateservers() {
 	}
 }
 
-func (m *Mode) pickcaptains() {
-	if m.teamgame() && len(m.who) >= 2 {
-		leng := len(m.who) / 2
-		i, j := rand.Intn(leng), rand.Intn(leng)+leng
-		if i > 0 && len(m.who)%2 != 0 {
-			i--
-		}
-		m.cap1, m.cap2 = m.who[i].user, m.who[j].user
-		m.cap1, _, _ = splituserstring(m.cap1)
-		m.cap2, _, _ = splituserstring(m.cap2)
-	}
-}
-
-func (m *Mode) promotestarting() {
-	nicks := make([]string, 0)
-	for _, u := range m.who {
-		nick, _, _ := splituserstring(u.user)
-		nicks = append(nicks, nick)
-	}
-	nicksstr := strings.Join(nicks, " ")
-	srvstr := ""
-	captainsstr := ""
-	if m.srv == nil {
-		srvstr = Violet + "but there are no online servers in its pool =["
-	} else {
-		host := fmt.Sprintf("%s:%s", m.srv.host(), m.srv.port())
-		if m.srv.password() != "" {
-			srvstr = csprintf("{pink}{b}connect %s;password %s",
-				host, m.srv.password())
-		} else {
-			srvstr = csprintf("{pink}{b}connect %s", host)
-		}
-	}
-	if m.teamgame() && len(m.who) >= 2 {
-		captainsstr = csprintf("{r} || team captains will be {red}%s{r} and {blue}%s{r}",
-			m.cap1, m.cap2)
-	}
-	if m.srv != nil {
-		s := csprintf("{cyan}%s{r} -> {dkblue}%s {green}[%d/%d] {orange}(%v)",
-			m.srv.alias(), m.srv.hostname(), len(m.srv.clients()), m.srv.maxclients(), m.srv.ping())
-		irc.privmsg(channel, s)
-	}
-	s := csprintf("{orange}{b}%s{b} is starting {r}-> %s {r}<- {orange}%s%s",
-		m.name, srvstr, nicksstr, captainsstr)
-	irc.privmsg(channel, s)
-	// After a delay, PM everyone added.
-	go func(nicks []string) {
-		time.Sleep(2 * time.Second)
-		for _, nick := range nicks {
-			s := csprintf("{orange}{b}%s{b} is starting {r}-> %s {r}<- {orange}%s%s",
-				m.name, srvstr, nick, captainsstr)
-			irc.privmsg(nick, s)
-			time.Sleep(60 * time.Millisecond)
-		}
-	}(nicks)
-}
-
 func readhist(fname string) ([]HistVal, error) {
 	f, err := os.OpenFile(fname, os.O_RDONLY|os.O_CREATE, 0)
 	if err != nil {
@@ -825,47 +1141,81 @@ func readhist(fname string) ([]HistVal, error) {
 	}
 	defer f.Close()
 	r := bufio.NewScanner(f)
-	hist := make([]HistVal, 0)
+	recs := make([]HistVal, 0)
 	for r.Scan() {
-		ss := strings.Split(r.Text(), "\t")
-		if len(ss) != 3 {
-			log.Println("bad entry in history")
-			continue
-		}
-		t, err := time.Parse(tlayout, ss[0])
+		h, err := parsehist(r.Text())
 		if err != nil {
 			log.Println(err)
 			continue
 		}
-		hist = append(hist, HistVal{t, ss[1], ss[2]})
+		recs = append(recs, h)
 	}
-	return hist, r.Err()
+	return recs, r.Err()
 }
 
-func appendhist(fname string, hist []HistVal) error {
-	f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0)
+func parsehist(line string) (HistVal, error) {
+	ss := strings.Split(line, "\t")
+	if ss[0] == strconv.Itoa(histversion) {
+		return parsehist2(ss[1:])
+	}
+	if len(ss) < 3 || len(ss) > 5 {
+		return HistVal{}, errors.New("bad entry in history")
+	}
+	// Old entries were written in local time.
+	t, err := time.ParseInLocation(tlayout, ss[0], time.Local)
 	if err != nil {
-		return err
+		return HistVal{}, err
 	}
-	defer f.Close()
-	for _, h := range hist {
-		t := h.t.Format(tlayout)
-		if _, err = fmt.Fprintf(f, "%s\t%s\t%s\n", t, h.mode, h.nick); err != nil {
-			return err
-		}
+	h := HistVal{t: t, mode: ss[1], nick: ss[2]}
+	if len(ss) >= 4 {
+		h.team, _ = strconv.Atoi(ss[3])
 	}
-	return nil
+	if len(ss) == 5 {
+		h.id, _ = strconv.Atoi(ss[4])
+	}
+	return h, nil
+}
+
+func (h HistVal) String() string {
+	if h.v == histversion {
+		return fmt.Sprintf("%d\t%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\t%t\t%s\t%s\t%d",
+			h.v, h.t.Format(time.RFC3339), h.mode, h.nick, h.team, h.id, h.account,
+			h.server, h.host, h.mapname, h.captain, h.result, h.subfor, int(h.length.Seconds()))
+	}
+	t := h.t.Format(tlayout)
+	switch {
+	case h.id != 0:
+		return fmt.Sprintf("%s\t%s\t%s\t%d\t%d", t, h.mode, h.nick, h.team, h.id)
+	case h.team != 0:
+		return fmt.Sprintf("%s\t%s\t%s\t%d", t, h.mode, h.nick, h.team)
+	}
+	return fmt.Sprintf("%s\t%s\t%s", t, h.mode, h.nick)
 }
 
-func loggamestart(modename string, players []Player) {
+func loggamestart(g *Game) {
 	t := time.Now()
-	newhist := make([]HistVal, 0, len(players))
-	for i := range players {
-		nick, _, _ := splituserstring(players[i].user)
-		nick = strings.Trim(nick, "`^_")
-		newhist = append(newhist, HistVal{t, modename, nick})
+	srv, host := "", ""
+	if g.srv != nil {
+		srv, host = g.srv.alias(), g.srv.addr()
 	}
-	if err := appendhist(histfile, newhist); err != nil {
+	newhist := make([]HistVal, 0, len(g.who))
+	for _, u := range g.who {
+		nick, _, _ := splituserstring(u.user)
+		newhist = append(newhist, HistVal{
+			v:       histversion,
+			t:       t,
+			mode:    g.name,
+			nick:    mainname(playername(u.user)),
+			team:    u.team,
+			id:      g.id,
+			account: irc.account(u.user),
+			server:  srv,
+			host:    host,
+			mapname: g.mapname,
+			captain: containsfold(g.caps, nick),
+		})
+	}
+	if err := hist.add(newhist); err != nil {
 		log.Println(err)
 	}
 }
@@ -887,23 +1237,13 @@ func execrc(fname string) error {
 		botfn, ok := botcmds[cl]
 		if !ok {
 			log.Printf("%s: no such command\n", cmd[0])
+			continue
 		}
 		botfn.fn("", "", cmd[1:]...)
 	}
 	return nil
 }
 
-func appendrc(fname, cmd string, args []string) {
-	f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	defer f.Close()
-	a := strings.Join(args, " ")
-	fmt.Fprintf(f, "%s %s\n", cmd, a)
-}
-
 func (cs Clients) String() string {
 	ss := make([]string, len(cs))
 	for i := range cs {
@@ -932,129 +1272,72 @@ func (top Top10) String() string {
 	return strings.Join(ss, ", ")
 }
 
-func top10month(where, who string, args ...string) bool {
-	top := findtop(28 * 24 * time.Hour)
-	if len(top) > 10 {
-		top = top[:10]
-	}
-	topmsg := fmt.Sprintf("top 10 modes over the past month: %s", top)
-	say(where, who, topmsg)
-	return true
-}
-
-func top10week(where, who string, args ...string) bool {
-	top := findtop(7 * 24 * time.Hour)
-	if len(top) > 10 {
-		top = top[:10]
-	}
-	topmsg := fmt.Sprintf("top 10 modes over the past week: %s", top)
-	say(where, who, topmsg)
-	return true
-}
-
-func top10players(where, who string, args ...string) bool {
-	top := findtopplayers(7 * 24 * time.Hour)
-	if len(top) > 10 {
-		top = top[:10]
-	}
-	topmsg := fmt.Sprintf("top 10 players over the past week: %s", top)
-	say(where, who, topmsg)
-	return true
-}
-
-func top25players(where, who string, args ...string) bool {
-	top := findtopplayers(28 * 24 * time.Hour)
-	if len(top) > 25 {
-		top = top[:25]
-	}
-	topmsg := fmt.Sprintf("top 10 players over the past week: %s", top)
-	say(where, who, topmsg)
-	return true
-}
-
-func topmost(where, who string, args ...string) bool {
-	top := findtopplayers(time.Duration(1<<63 - 1))
-	if len(top) > 10 {
-		top = top[:10]
-	}
-	topmsg := fmt.Sprintf("top 10 players of all time: %s", top)
-	say(where, who, topmsg)
-	return true
-}
-
-func findtop(limit time.Duration) Top10 {
-	t := time.Now()
-	top := make(Top10, 0)
-	count := make(map[string]int)
-	hist, err := readhist(histfile)
-	if err != nil {
-		log.Println(err)
-		return nil
-	}
-	for _, h := range hist {
-		if t.Sub(h.t) > limit {
-			break
-		}
-		count[h.mode] = count[h.mode] + 1
-	}
-	for k, v := range count {
-		top = append(top, Top10Val{k, v})
-	}
-	sort.Sort(top)
-	return top
-}
-
-func findtopplayers(limit time.Duration) Top10 {
-	t := time.Now()
-	top := make(Top10, 0)
-	tally := make(map[string]int)
-	hist, err := readhist(histfile)
-	if err != nil {
-		log.Println(err)
-		return nil
-	}
-	for _, h := range hist {
-		if t.Sub(h.t) > limit {
-			break
-		}
-		tally[h.nick] = tally[h.nick] + 1
-	}
-	for k, v := range tally {
-		top = append(top, Top10Val{k, v})
-	}
-	sort.Sort(top)
-	return top
-}
-
 func showversion(where, who string, args ...string) bool {
 	say(where, who, version)
 	return true
 }
 
+// Remove players whose expiry time has lapsed, warning those who are
+// about to be removed.
 func chkexpire() {
 	removed := false
 	now := time.Now()
-	for i, m := range modes {
-		for _, u := range m.who {
-			if now.Before(u.expire) {
-				continue
+	warn := make(map[string][]string) // Mode names by user.
+	for _, m := range modes {
+		var expired []string
+		for i, u := range m.who {
+			switch {
+			case !now.Before(u.expire):
+				expired = append(expired, u.user)
+			case !u.warned && u.expire.Sub(now) <= expirewarn:
+				m.who[i].warned = true
+				warn[u.user] = append(warn[u.user], m.name)
 			}
-			modes[i].removeplayer(u.user)
+		}
+		for _, u := range expired {
+			m.removeplayer(u)
 			removed = true
 		}
 	}
+	for u, ms := range warn {
+		nick, _, _ := splituserstring(u)
+		sort.Strings(ms)
+		irc.notice(nick, csprintf("{pink}you will be removed from {b}%s{b} in under %v; !expire to stay longer",
+			strings.Join(ms, ", "), expirewarn))
+	}
 	if removed {
 		updatetopic()
 	}
 }
 
+// Functions queued to run in the main loop, e.g. by after.
+var later = make(chan func(), 16)
+
+// Run fn in the main loop after d has elapsed.
+func after(d time.Duration, fn func()) *time.Timer {
+	return time.AfterFunc(d, func() { later <- fn })
+}
+
 func usage() {
 	log.SetFlags(0)
-	log.Fatal("usage: pkup [ flags ] host:port channel")
+	log.Fatal("usage: pkup [ flags ] host:port channel\n       pkup [ flags ] export [ export flags ] [ table ]")
 }
 
-func init() {
+// Parse the flags and load the saved settings, history and state.
+func setup() {
 	flag.Parse()
+	if *tzflag != "" {
+		loc, err := time.LoadLocation(*tzflag)
+		if err != nil {
+			log.SetFlags(0)
+			log.Fatalln(err)
+		}
+		deftz = loc
+	}
+	if flag.Arg(0) == "export" {
+		exportmain(flag.Args()[1:])
+		os.Exit(0)
+	}
 	if flag.NArg() != 2 {
 		usage()
 	}
@@ -1062,7 +1345,51 @@ func init() {
 	ccto = strings.Split(*ccflag, ",")
 	host = flag.Arg(0)
 	channel = flag.Arg(1)
-	if err := execrc(runcommands); err != nil {
+	if err := loadconfig(configfile, runcommands); err != nil {
+		log.SetFlags(0)
+		log.Fatalln(err)
+	}
+	if err := readbans(bansfile); err != nil {
+		log.SetFlags(0)
+		log.Fatalln(err)
+	}
+	if err := readratings(ratingsfile); err != nil {
+		log.SetFlags(0)
+		log.Fatalln(err)
+	}
+	if err := readladders(ladderfile); err != nil {
+		log.SetFlags(0)
+		log.Fatalln(err)
+	}
+	if err := readevents(schedulefile); err != nil {
+		log.SetFlags(0)
+		log.Fatalln(err)
+	}
+	if err := readzones(zonesfile); err != nil {
+		log.SetFlags(0)
+		log.Fatalln(err)
+	}
+	if err := readsubs(subsfile); err != nil {
+		log.SetFlags(0)
+		log.Fatalln(err)
+	}
+	if err := readseen(seenfile); err != nil {
+		log.SetFlags(0)
+		log.Fatalln(err)
+	}
+	if err := readaliases(aliasfile); err != nil {
+		log.SetFlags(0)
+		log.Fatalln(err)
+	}
+	var err error
+	if hist, err = openhist(histdbfile, histfile); err != nil {
+		log.SetFlags(0)
+		log.Fatalln(err)
+	}
+	if id := hist.lastid(); id >= nextgameid {
+		nextgameid = id + 1
+	}
+	if err := readstate(statefile); err != nil {
 		log.SetFlags(0)
 		log.Fatalln(err)
 	}
@@ -1070,18 +1397,25 @@ func init() {
 }
 
 func main() {
+	setup()
 	irc = newIRCconn(*nick, *user, *real, "")
 	if err := irc.dial(host); err != nil {
 		log.Fatal(err)
 	}
 	var tick <-chan time.Time // Starts closed
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
 	for {
 		select {
 		case ev := <-irc.Events:
+			noteseen(ev)
 			switch ev.cmd {
 			case "welcome":
 				irc.join(channel)
 				updatetopic()
+				resumestate()
+				startfull()
+				savestate()
 				tick = time.Tick(time.Minute)
 			case "privmsg":
 				if ev.msg[0] != '!' {
@@ -1099,11 +1433,37 @@ func main() {
 				}
 				ok = botfn.fn(ev.args[0], ev.src, cmd[1:]...)
 				if ok && botfn.save {
-					appendrc(runcommands, cl, cmd[1:])
+					writeconfig(configfile)
 				}
+				savestate()
 			}
 		case <-tick:
 			chkexpire()
+			chkgames()
+			decayladders()
+			chkschedule()
+			writeseen(seenfile)
+			savestate()
+		case fn := <-later:
+			fn()
+			savestate()
+		case sig := <-sigs:
+			if sig != syscall.SIGHUP {
+				savestate()
+				writeseen(seenfile)
+				log.Println("quitting on", sig)
+				irc.quit("Leaving")
+				os.Exit(0)
+			}
+			changes, err := reloadconfig()
+			if err != nil {
+				log.Printf("%s not reloaded: %v\n", configfile, err)
+				break
+			}
+			log.Printf("reloaded %s: %s\n", configfile, strings.Join(changes, ", "))
+			updatetopic()
+			startfull()
+			savestate()
 		}
 	}
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// Set up a bot that isn't connected, with its files in a temporary
+// directory and no modes, games or history.
+func testbot(t *testing.T) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	irc = newIRCconn("pkup", "pkup", "pkup", "")
+	irc.out = make(chan string, 1000)
+	channel = "#pickup"
+	modes = make(map[string]*Mode)
+	games = nil
+	cups = nil
+	nextgameid = 1
+	aliases = make(map[string]string)
+	initial = false
+	var err error
+	if hist, err = openhist(histdbfile, histfile); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Run fn, failing if it doesn't return within a few seconds.
+func within(t *testing.T, fn func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("hung")
+	}
+}
+
+// A failed write leaves the old file as it was.
+func TestWriteatomic(t *testing.T) {
+	t.Chdir(t.TempDir())
+	write := func(s string, err error) error {
+		return writeatomic("f", func(w *bufio.Writer) error {
+			w.WriteString(s)
+			return err
+		})
+	}
+	if err := write("one\n", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := write("two\n", errors.New("failed")); err == nil {
+		t.Error("failed write succeeded")
+	}
+	if b, _ := os.ReadFile("f"); string(b) != "one\n" {
+		t.Errorf("file holds %q", b)
+	}
+	if _, err := os.Stat("f.tmp"); err == nil {
+		t.Error("temporary file left behind")
+	}
+}
+
+func TestNteams(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		teams int // Set with !modeset, or 0.
+		want  int
+	}{
+		{"ctf", 0, 2},
+		{"CTF2", 0, 2},
+		{"tdm_eu", 0, 2},
+		{"2v2", 0, 2},
+		{"4v4-ctf", 0, 2},
+		{"ca", 0, 2},
+		{"duel", 0, 1},
+		{"1v1", 0, 1},
+		{"duel_ca_practice", 0, 1},
+		{"1v1-ctf", 0, 1},
+		{"cash", 0, 1},
+		{"ffa", 0, 1},
+		{"ctfx", 0, 1},
+		{"duel", 4, 4},
+	} {
+		m := &Mode{name: c.name, teams: c.teams}
+		if got := m.nteams(); got != c.want {
+			t.Errorf("%s, teams %d: %d teams, want %d", c.name, c.teams, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A vote on which map a game is played on.
+type MapVote struct {
+	g       *Game
+	choices []string
+	votes   map[string]int // Index into choices by player.
+}
+
+const (
+	mapchoices  = 3                // Maps offered in a vote.
+	mapvotetime = 30 * time.Second // How long players have to vote.
+)
+
+// Up to n maps from m's pool, picked at random but weighted against
+// maps played recently in the mode. The last game's map is only
+// offered if there aren't enough others.
+func (m *Mode) mapchoices(n int) []string {
+	// Games since each map was last played in the mode.
+	since := make(map[string]int)
+	k := 0
+	for i := len(games) - 1; i >= 0; i-- {
+		g := games[i]
+		if !strings.EqualFold(g.name, m.name) || g.mapname == "" {
+			continue
+		}
+		if _, ok := since[strings.ToLower(g.mapname)]; !ok {
+			since[strings.ToLower(g.mapname)] = k
+		}
+		k++
+	}
+	pool := make([]string, len(m.maps))
+	weights := make([]int, len(m.maps))
+	copy(pool, m.maps)
+	for i, mp := range pool {
+		w, ok := since[strings.ToLower(mp)]
+		if !ok || w > len(pool) {
+			w = len(pool)
+		}
+		weights[i] = w
+	}
+	var choices []string
+	for len(choices) < n && len(pool) > 0 {
+		total := 0
+		for _, w := range weights {
+			total += w
+		}
+		i := rand.Intn(len(pool))
+		if total > 0 {
+			r := rand.Intn(total)
+			for i = 0; r >= weights[i]; i++ {
+				r -= weights[i]
+			}
+		}
+		choices = append(choices, pool[i])
+		pool = append(pool[:i], pool[i+1:]...)
+		weights = append(weights[:i], weights[i+1:]...)
+	}
+	return choices
+}
+
+// Choose g's map, holding a vote if the mode's pool offers a choice.
+func (g *Game) choosemap() {
+	choices := g.mode.mapchoices(mapchoices)
+	switch len(choices) {
+	case 0:
+		return
+	case 1:
+		g.mapname = choices[0]
+		return
+	}
+	v := &MapVote{g: g, choices: choices, votes: make(map[string]int)}
+	g.vote = v
+	irc.privmsg(channel, v.String())
+	after(mapvotetime, func() {
+		if g.vote == v {
+			v.close()
+		}
+	})
+}
+
+// The choices and their votes so far.
+func (v *MapVote) String() string {
+	count := v.count()
+	ss := make([]string, len(v.choices))
+	for i, mp := range v.choices {
+		ss[i] = fmt.Sprintf("%d) %s [%d]", i+1, mp, count[i])
+	}
+	return csprintf("{orange}{b}%s{b} #%d{r} map vote: {orange}%s{r}; !vote map",
+		v.g.name, v.g.id, strings.Join(ss, " "))
+}
+
+func (v *MapVote) count() []int {
+	count := make([]int, len(v.choices))
+	for _, i := range v.votes {
+		count[i]++
+	}
+	return count
+}
+
+// Settle the vote on the most voted map, choosing at random between
+// ties, and launch the game if its teams were waiting on it.
+func (v *MapVote) close() {
+	count := v.count()
+	best := 0
+	for _, n := range count {
+		if n > best {
+			best = n
+		}
+	}
+	var top []string
+	for i, n := range count {
+		if n == best {
+			top = append(top, v.choices[i])
+		}
+	}
+	g := v.g
+	g.mapname = top[rand.Intn(len(top))]
+	g.vote = nil
+	irc.privmsg(channel, csprintf("{orange}{b}%s{b} #%d{r} will be played on {orange}{b}%s{b}{r} (%d votes)",
+		g.name, g.id, g.mapname, best))
+	if g.state == Voting {
+		g.launch()
+	}
+}
+
+func vote(where, who string, args ...string) bool {
+	if len(args) != 1 {
+		sayusage(where, who, "usage: !vote map")
+		return false
+	}
+	var v *MapVote
+	for i := len(games) - 1; i >= 0 && v == nil; i-- {
+		if games[i].vote != nil && games[i].playerindex(who) >= 0 {
+			v = games[i].vote
+		}
+	}
+	if v == nil {
+		sayusage(where, who, "you aren't in a game voting on its map")
+		return false
+	}
+	choice := -1
+	if n, err := strconv.Atoi(args[0]); err == nil && n >= 1 && n <= len(v.choices) {
+		choice = n - 1
+	}
+	for i, mp := range v.choices {
+		if strings.EqualFold(mp, args[0]) {
+			choice = i
+		}
+	}
+	if choice < 0 {
+		sayusage(where, who, fmt.Sprintf("%s isn't one of the choices", args[0]))
+		return false
+	}
+	v.votes[who] = choice
+	if len(v.votes) == len(v.g.who) {
+		v.close()
+		return true
+	}
+	say(where, who, v.String())
+	return true
+}
+
+// Add maps to, delete maps from or clear a mode's map pool.
+func mappool(where, who string, args ...string) bool {
+	usage := "usage: !mappool mode add|del map ... | !mappool mode clear"
+	if len(args) < 2 || (strings.ToLower(args[1]) != "clear" && len(args) < 3) {
+		if initial {
+			log.Println(usage)
+		} else {
+			sayusage(where, who, usage)
+		}
+		return false
+	}
+	m, ok := modes[strings.ToLower(args[0])]
+	if !ok {
+		if initial {
+			log.Printf("%s: no such mode\n", args[0])
+		} else {
+			sayusage(where, who, fmt.Sprintf("%s: no such mode", args[0]))
+		}
+		return false
+	}
+	switch strings.ToLower(args[1]) {
+	case "add":
+		for _, mp := range args[2:] {
+			if m.mapindex(mp) < 0 {
+				m.maps = append(m.maps, mp)
+			}
+		}
+	case "del":
+		for _, mp := range args[2:] {
+			if i := m.mapindex(mp); i >= 0 {
+				m.maps = append(m.maps[:i], m.maps[i+1:]...)
+			}
+		}
+	case "clear":
+		m.maps = nil
+	default:
+		if initial {
+			log.Println(usage)
+		} else {
+			sayusage(where, who, usage)
+		}
+		return false
+	}
+	if !initial {
+		showmaps(where, who, m.name)
+	}
+	return true
+}
+
+func (m *Mode) mapindex(mp string) int {
+	for i := range m.maps {
+		if strings.EqualFold(m.maps[i], mp) {
+			return i
+		}
+	}
+	return -1
+}
+
+func showmaps(where, who string, args ...string) bool {
+	var ms []*Mode
+	if len(args) > 0 {
+		for _, a := range args {
+			m, ok := modes[strings.ToLower(a)]
+			if !ok {
+				sayusage(where, who, fmt.Sprintf("%s: no such mode", a))
+				return false
+			}
+			ms = append(ms, m)
+		}
+	} else {
+		for _, m := range modes {
+			if len(m.maps) > 0 {
+				ms = append(ms, m)
+			}
+		}
+		sort.Sort(Modes(ms))
+	}
+	if len(ms) == 0 {
+		say(where, who, "no map pools")
+		return true
+	}
+	for _, m := range ms {
+		pool := "no maps"
+		if len(m.maps) > 0 {
+			pool = strings.Join(m.maps, " ")
+		}
+		say(where, who, csprintf("{orange}{b}%s{b}{r}: %s", m.name, pool))
+		time.Sleep(60 * time.Millisecond)
+	}
+	return true
+}
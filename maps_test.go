@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+// The last game's map is only offered when the pool runs short.
+func TestMapchoices(t *testing.T) {
+	testbot(t)
+	m := &Mode{name: "ctf", nneeded: 4, maps: []string{"q3dm6", "q3dm7", "q3dm17", "q3tourney2"}}
+	games = []*Game{{name: "ctf", mapname: "q3dm17"}, {name: "duel", mapname: "q3dm6"}}
+	for i := 0; i < 100; i++ {
+		choices := m.mapchoices(3)
+		if len(choices) != 3 {
+			t.Fatalf("choices %v", choices)
+		}
+		for _, mp := range choices {
+			if mp == "q3dm17" {
+				t.Fatalf("offered the last map: %v", choices)
+			}
+		}
+	}
+	if choices := m.mapchoices(5); len(choices) != 4 {
+		t.Errorf("choices %v from 4 maps", choices)
+	}
+}
+
+// The most voted map wins the vote.
+func TestMapVote(t *testing.T) {
+	testbot(t)
+	g := &Game{id: 1, name: "ctf", state: Playing}
+	v := &MapVote{g: g, choices: []string{"q3dm6", "q3dm7"},
+		votes: map[string]int{"alice!u@h": 1, "bob!u@h": 0, "carol!u@h": 1}}
+	g.vote = v
+	v.close()
+	if g.mapname != "q3dm7" || g.vote != nil {
+		t.Errorf("map %q, vote %v", g.mapname, g.vote)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A player who wants to hear when a mode is close to filling.
+type Subscriber struct {
+	nick string
+	pm   bool // Message them rather than highlight them in the channel.
+}
+
+const (
+	subsfile        = "pickupsubs.log"
+	promotemodewait = 5 * time.Minute  // Time between promotions of a mode.
+	promoteuserwait = 15 * time.Minute // Time between a player's !promotes.
+)
+
+var (
+	subs       = make(map[string][]Subscriber) // Subscribers by lower-cased mode name.
+	promotedby = make(map[string]time.Time)    // Last !promote by player name.
+)
+
+func promote(where, who string, args ...string) bool {
+	var m *Mode
+	if len(args) > 0 {
+		m = modes[strings.ToLower(args[0])]
+		if m == nil {
+			sayusage(where, who, fmt.Sprintf("%s: no such mode", args[0]))
+			return false
+		}
+	} else {
+		for _, mm := range modes {
+			if m == nil || len(mm.who) > len(m.who) {
+				m = mm
+			}
+		}
+	}
+	if m == nil || len(m.who) >= m.nneeded {
+		return false
+	}
+	if !irc.isopped(who, channel) {
+		name := strings.ToLower(playername(who))
+		if d := time.Since(m.promoted); d < promotemodewait {
+			sayusage(where, who, fmt.Sprintf("%s was promoted %v ago; try again in %v",
+				m.name, d.Round(time.Second), (promotemodewait-d).Round(time.Second)))
+			return false
+		}
+		if d := time.Since(promotedby[name]); d < promoteuserwait {
+			sayusage(where, who, fmt.Sprintf("you can promote again in %v",
+				(promoteuserwait-d).Round(time.Second)))
+			return false
+		}
+		promotedby[name] = time.Now()
+	}
+	m.promote()
+	return true
+}
+
+// Ask the channel and the -cc channels to add for m, and call its
+// subscribers.
+func (m *Mode) promote() {
+	m.promoted = time.Now()
+	broadcast(csprintf("{pink}Please !add for {b}%s{b} {cyan}[%d/%d]{pink}, %d needed, in {b}%s{b}!",
+		m.name, len(m.who), m.nneeded, m.nneeded-len(m.who), channel))
+	var hl, pm []string
+	for _, s := range subs[strings.ToLower(m.name)] {
+		if m.nickindex(s.nick) >= 0 || playing(s.nick) {
+			continue
+		}
+		if s.pm {
+			pm = append(pm, s.nick)
+		} else {
+			hl = append(hl, s.nick)
+		}
+	}
+	if len(hl) > 0 {
+		irc.privmsg(channel, csprintf("{orange}{b}%s{b}{r} {cyan}[%d/%d]{r}: %s",
+			m.name, len(m.who), m.nneeded, strings.Join(hl, " ")))
+	}
+	if len(pm) > 0 {
+		s := csprintf("{b}%s{b} {cyan}[%d/%d]{r} needs %d more; !add %s in %s",
+			m.name, len(m.who), m.nneeded, m.nneeded-len(m.who), m.name, channel)
+		go func() {
+			for _, nick := range pm {
+				irc.privmsg(nick, s)
+				time.Sleep(60 * time.Millisecond)
+			}
+		}()
+	}
+}
+
+// Position of the player with nick in m, or -1.
+func (m *Mode) nickindex(nick string) int {
+	for i, p := range m.who {
+		n, _, _ := splituserstring(p.user)
+		if strings.EqualFold(n, nick) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Is the player called nick in an active game?
+func playing(nick string) bool {
+	for _, g := range games {
+		if g.active() && g.nickindex(nick) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Promote modes that have reached their promote threshold, at most once
+// every promotemodewait.
+func autopromote() {
+	for _, m := range modes {
+		if m.promoteat > 0 && len(m.who) >= m.promoteat && len(m.who) < m.nneeded &&
+			time.Since(m.promoted) >= promotemodewait {
+			m.promote()
+		}
+	}
+}
+
+func subscribe(where, who string, args ...string) bool {
+	usage := "usage: !subscribe [mode ...] [pm]"
+	nick, _, _ := splituserstring(who)
+	pm := false
+	if len(args) > 0 && strings.ToLower(args[len(args)-1]) == "pm" {
+		pm = true
+		args = args[:len(args)-1]
+	}
+	if len(args) == 0 {
+		if pm {
+			sayusage(where, who, usage)
+			return false
+		}
+		var ms []string
+		for k, ss := range subs {
+			if subindex(ss, nick) >= 0 {
+				ms = append(ms, k)
+			}
+		}
+		if len(ms) == 0 {
+			say(where, who, "you aren't subscribed to any modes")
+			return true
+		}
+		sort.Strings(ms)
+		say(where, who, "subscribed to: "+strings.Join(ms, " "))
+		return true
+	}
+	for _, a := range args {
+		if _, ok := modes[strings.ToLower(a)]; !ok {
+			sayusage(where, who, fmt.Sprintf("%s: no such mode", a))
+			return false
+		}
+	}
+	for _, a := range args {
+		k := strings.ToLower(a)
+		if i := subindex(subs[k], nick); i >= 0 {
+			subs[k][i].pm = pm
+		} else {
+			subs[k] = append(subs[k], Subscriber{nick, pm})
+		}
+	}
+	if err := writesubs(subsfile); err != nil {
+		log.Println(err)
+	}
+	how := "highlighted"
+	if pm {
+		how = "messaged"
+	}
+	say(where, who, fmt.Sprintf("you will be %s when %s need players", how, strings.Join(args, ", ")))
+	return true
+}
+
+func unsubscribe(where, who string, args ...string) bool {
+	nick, _, _ := splituserstring(who)
+	n := 0
+	for k, ss := range subs {
+		if len(args) > 0 && !containsfold(args, k) {
+			continue
+		}
+		if i := subindex(ss, nick); i >= 0 {
+			subs[k] = append(ss[:i], ss[i+1:]...)
+			if len(subs[k]) == 0 {
+				delete(subs, k)
+			}
+			n++
+		}
+	}
+	if n == 0 {
+		sayusage(where, who, "you aren't subscribed to that")
+		return false
+	}
+	if err := writesubs(subsfile); err != nil {
+		log.Println(err)
+	}
+	say(where, who, fmt.Sprintf("unsubscribed from %d modes", n))
+	return true
+}
+
+func subindex(ss []Subscriber, nick string) int {
+	for i, s := range ss {
+		if strings.EqualFold(s.nick, nick) {
+			return i
+		}
+	}
+	return -1
+}
+
+func containsfold(ss []string, s string) bool {
+	for i := range ss {
+		if strings.EqualFold(ss[i], s) {
+			return true
+		}
+	}
+	return false
+}
+
+func readsubs(fname string) error {
+	f, err := os.OpenFile(fname, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewScanner(f)
+	for r.Scan() {
+		ss := strings.Split(r.Text(), "\t")
+		if len(ss) != 3 {
+			log.Println("bad entry in subscriptions")
+			continue
+		}
+		subs[ss[0]] = append(subs[ss[0]], Subscriber{ss[1], ss[2] == "pm"})
+	}
+	return r.Err()
+}
+
+func writesubs(fname string) error {
+	return writeatomic(fname, func(w *bufio.Writer) error {
+		for k, ss := range subs {
+			for _, s := range ss {
+				how := "highlight"
+				if s.pm {
+					how = "pm"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\n", k, s.nick, how)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Subscribers already added or playing aren't called.
+func TestPromoteSubscribers(t *testing.T) {
+	testbot(t)
+	m := &Mode{name: "ctf", nneeded: 4}
+	modes["ctf"] = m
+	m.addplayer("erin!u@h", time.Now())
+	g := newgame(&Mode{name: "duel", nneeded: 2}, []Player{{user: "Alice!u@h"}, {user: "carol!u@h"}})
+	g.state = Playing
+	subs["ctf"] = []Subscriber{{nick: "alice"}, {nick: "bob"}, {nick: "erin"}, {nick: "carol", pm: true}, {nick: "dave", pm: true}}
+	t.Cleanup(func() { delete(subs, "ctf") })
+	within(t, m.promote)
+	var out []string
+	deadline := time.After(2 * time.Second)
+	for len(out) == 0 || !strings.HasPrefix(out[len(out)-1], "PRIVMSG dave ") {
+		select {
+		case s := <-irc.out:
+			out = append(out, s)
+		case <-deadline:
+			t.Fatalf("no PM to dave: %q", out)
+		}
+	}
+	all := strings.Join(out, "\n")
+	if !strings.Contains(all, "bob") || strings.Contains(all, "alice") || strings.Contains(all, "erin") ||
+		strings.Contains(all, "carol") {
+		t.Errorf("promoted as:\n%s", all)
+	}
+}
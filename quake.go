@@ -12,6 +12,7 @@ import (
 
 type QServer struct {
 	kv       map[string]string
+	qgame    string
 	qalias   string
 	qhost    string
 	qport    string
@@ -21,10 +22,10 @@ type QServer struct {
 	qonline  bool
 }
 
-func newqserver(alias, host, pass string) Server {
+func newqserver(game, alias, host, pass string) Server {
 	srv := &QServer{
-		kv:     make(map[string]string, 16),
-		qalias: alias, qpass: pass,
+		kv:    make(map[string]string, 16),
+		qgame: game, qalias: alias, qpass: pass,
 	}
 	split := strings.Split(host, ":")
 	srv.qhost = split[0]
@@ -101,6 +102,14 @@ func (srv *QServer) host() string {
 	return srv.qhost
 }
 
+func (srv *QServer) kind() string {
+	return srv.qgame
+}
+
+func (srv *QServer) addr() string {
+	return srv.qhost + ":" + srv.qport
+}
+
 func (srv *QServer) hostname() string {
 	return colourconv(srv.kv["sv_hostname"])
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Does m have enough players to start a game?
+func (m *Mode) full() bool {
+	return m.nneeded > 0 && len(m.who) >= m.nneeded
+}
+
+// The mean time the players who would play m's next game have waited
+// by now.
+func (m *Mode) waited(now time.Time) time.Duration {
+	n := m.nneeded
+	if n > len(m.who) {
+		n = len(m.who)
+	}
+	if n == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, u := range m.who[:n] {
+		sum += now.Sub(u.added)
+	}
+	return sum / time.Duration(n)
+}
+
+// Start games in every full mode. When several modes are full at once,
+// higher priority modes start first, then those whose players have
+// waited longest. Players can only play in one game, so starting one
+// may leave the others short. Waits are measured at one time, and ties
+// are broken by name.
+func startfull() {
+	now := time.Now()
+	for {
+		var full Modes
+		for _, m := range modes {
+			if m.full() {
+				full = append(full, m)
+			}
+		}
+		if len(full) == 0 {
+			return
+		}
+		sort.Slice(full, func(i, j int) bool {
+			a, b := full[i], full[j]
+			if a.priority != b.priority {
+				return a.priority > b.priority
+			}
+			if wa, wb := a.waited(now), b.waited(now); wa != wb {
+				return wa > wb
+			}
+			return strings.ToLower(a.name) < strings.ToLower(b.name)
+		})
+		full[0].startgame()
+	}
+}
+
+func setmodepriority(where, who string, args ...string) bool {
+	if len(args) != 2 {
+		usage := "usage: !modepriority mode n"
+		if initial {
+			log.Println(usage)
+		} else {
+			sayusage(where, who, usage)
+		}
+		return false
+	}
+	return modeset(where, who, args[0], "priority", args[1])
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Modes filled by the same !add start in a fixed order: by priority,
+// then by how long their players have waited, then by name.
+func TestStartfull(t *testing.T) {
+	for _, c := range []struct {
+		prio map[string]int
+		adds []string // Each player's !add, e.g. "a alpha beta", or "a" for every mode.
+		want string   // The mode that starts.
+	}{
+		{adds: []string{"a", "b"}, want: "alpha"},
+		{prio: map[string]int{"gamma": 1}, adds: []string{"a", "b"}, want: "gamma"},
+		{adds: []string{"a beta", "b alpha", "c"}, want: "beta"},
+		{adds: []string{"a gamma", "b beta", "c"}, want: "gamma"},
+		{prio: map[string]int{"alpha": 1}, adds: []string{"a gamma", "b alpha", "c"}, want: "alpha"},
+	} {
+		for run := 0; run < 20; run++ {
+			testbot(t)
+			for _, name := range []string{"alpha", "beta", "gamma"} {
+				modes[name] = &Mode{name: name, nneeded: 2, priority: c.prio[name]}
+			}
+			within(t, func() {
+				for _, a := range c.adds {
+					ss := strings.Fields(a)
+					add("#pickup", ss[0]+"!u@h", ss[1:]...)
+				}
+			})
+			if len(games) != 1 || games[0].name != c.want {
+				t.Fatalf("%v, %q: started %v, want %s", c.prio, c.adds, games, c.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"math/bits"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Glicko-2 rating, on the Glicko scale.
+type Rating struct {
+	r   float64 // Rating.
+	rd  float64 // Rating deviation.
+	vol float64 // Volatility.
+}
+
+const (
+	ratingsfile   = "pickupratings.log"
+	defaultrating = 1500.0
+	defaultrd     = 350.0
+	defaultvol    = 0.06
+	glickotau     = 0.5      // Constrains volatility changes.
+	glickoscale   = 173.7178 // Glicko to Glicko-2 scale.
+	maxexhaustive = 20       // Largest game balanced by trying every split.
+)
+
+// Skill ratings by lower-cased mode name, then by player name.
+var ratings = make(map[string]map[string]Rating)
+
+// Team pick methods.
+var pickmethods = []string{"captains", "random", "balance"}
+
+// Name under which a player's history and ratings are kept.
+func playername(user string) string {
+	nick, _, _ := splituserstring(user)
+	return strings.Trim(nick, "`^_")
+}
+
+func getrating(mode, name string) Rating {
+	if r, ok := ratings[strings.ToLower(mode)][strings.ToLower(name)]; ok {
+		return r
+	}
+	return Rating{defaultrating, defaultrd, defaultvol}
+}
+
+func putrating(mode, name string, r Rating) {
+	k := strings.ToLower(mode)
+	if ratings[k] == nil {
+		ratings[k] = make(map[string]Rating)
+	}
+	ratings[k][strings.ToLower(name)] = r
+}
+
+func rating(mode, name string) float64 {
+	return getrating(mode, name).r
+}
+
+func glickog(phi float64) float64 {
+	return 1 / math.Sqrt(1+3*phi*phi/(math.Pi*math.Pi))
+}
+
+// The rating after games with scores ss (1 win, 0.5 draw, 0 loss)
+// against opps, following Glickman's Glicko-2 paper.
+func (rt Rating) update(opps []Rating, ss []float64) Rating {
+	if len(opps) == 0 {
+		return rt
+	}
+	mu := (rt.r - defaultrating) / glickoscale
+	phi := rt.rd / glickoscale
+	var vinv, sum float64
+	for j, opp := range opps {
+		muj := (opp.r - defaultrating) / glickoscale
+		g := glickog(opp.rd / glickoscale)
+		e := 1 / (1 + math.Exp(-g*(mu-muj)))
+		vinv += g * g * e * (1 - e)
+		sum += g * (ss[j] - e)
+	}
+	v := 1 / vinv
+	delta := v * sum
+
+	// New volatility by the Illinois algorithm.
+	a := math.Log(rt.vol * rt.vol)
+	f := func(x float64) float64 {
+		ex := math.Exp(x)
+		d := phi*phi + v + ex
+		return ex*(delta*delta-phi*phi-v-ex)/(2*d*d) - (x-a)/(glickotau*glickotau)
+	}
+	A := a
+	var B float64
+	if delta*delta > phi*phi+v {
+		B = math.Log(delta*delta - phi*phi - v)
+	} else {
+		k := 1.0
+		for f(a-k*glickotau) < 0 {
+			k++
+		}
+		B = a - k*glickotau
+	}
+	fA, fB := f(A), f(B)
+	for math.Abs(B-A) > 1e-6 {
+		C := A + (A-B)*fA/(fB-fA)
+		fC := f(C)
+		if fC*fB <= 0 {
+			A, fA = B, fB
+		} else {
+			fA /= 2
+		}
+		B, fB = C, fC
+	}
+	vol := math.Exp(A / 2)
+
+	phistar := math.Sqrt(phi*phi + vol*vol)
+	phi = 1 / math.Sqrt(1/(phistar*phistar)+1/v)
+	mu += phi * phi * sum
+	return Rating{mu*glickoscale + defaultrating, phi * glickoscale, vol}
+}
+
+// A team's players rated as one opponent: mean rating, RMS deviation.
+func teamrating(mode string, names []string) Rating {
+	var t Rating
+	for _, n := range names {
+		rt := getrating(mode, n)
+		t.r += rt.r
+		t.rd += rt.rd * rt.rd
+	}
+	if len(names) > 0 {
+		t.r /= float64(len(names))
+		t.rd = math.Sqrt(t.rd / float64(len(names)))
+	}
+	return t
+}
+
+// Rate a finished game between teams of player names. Each player
+// plays one game against each other team taken as a whole: the winners
+// beat every other team and the losers lose to the winners, but losing
+// teams aren't rated against each other. In a draw every team draws.
+func rategame(mode string, teams [][]string, winner int) {
+	trs := make([]Rating, len(teams))
+	for t := range teams {
+		trs[t] = teamrating(mode, teams[t])
+	}
+	next := make([][]Rating, len(teams))
+	for t := range teams {
+		var opps []Rating
+		var ss []float64
+		for u := range teams {
+			switch {
+			case u == t:
+			case winner == 0:
+				opps, ss = append(opps, trs[u]), append(ss, 0.5)
+			case winner == t+1:
+				opps, ss = append(opps, trs[u]), append(ss, 1)
+			case winner == u+1:
+				opps, ss = append(opps, trs[u]), append(ss, 0)
+			}
+		}
+		for _, n := range teams[t] {
+			next[t] = append(next[t], getrating(mode, n).update(opps, ss))
+		}
+	}
+	for t := range teams {
+		for i, n := range teams[t] {
+			putrating(mode, n, next[t][i])
+		}
+	}
+	if err := writeratings(ratingsfile); err != nil {
+		log.Println(err)
+	}
+}
+
+func readratings(fname string) error {
+	f, err := os.OpenFile(fname, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewScanner(f)
+	for r.Scan() {
+		ss := strings.Split(r.Text(), "\t")
+		if len(ss) != 3 && len(ss) != 5 {
+			log.Println("bad entry in ratings")
+			continue
+		}
+		rt := Rating{defaultrating, defaultrd, defaultvol}
+		var err error
+		for i, p := range []*float64{&rt.r, &rt.rd, &rt.vol}[:len(ss)-2] {
+			if *p, err = strconv.ParseFloat(ss[i+2], 64); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		putrating(ss[0], ss[1], rt)
+	}
+	return r.Err()
+}
+
+func writeratings(fname string) error {
+	return writeatomic(fname, func(w *bufio.Writer) error {
+		for mode, rs := range ratings {
+			for name, rt := range rs {
+				fmt.Fprintf(w, "%s\t%s\t%.1f\t%.1f\t%.6f\n", mode, name, rt.r, rt.rd, rt.vol)
+			}
+		}
+		return nil
+	})
+}
+
+func setrating(where, who string, args ...string) bool {
+	if len(args) != 3 {
+		sayusage(where, who, "usage: !setrating nick mode rating")
+		return false
+	}
+	n, err := strconv.ParseFloat(args[2], 64)
+	if err != nil {
+		sayusage(where, who, "error: bad rating")
+		return false
+	}
+	name := strings.Trim(args[0], "`^_")
+	rt := getrating(args[1], name)
+	rt.r = n
+	putrating(args[1], name, rt)
+	if err := writeratings(ratingsfile); err != nil {
+		log.Println(err)
+	}
+	return true
+}
+
+func setpickmethod(where, who string, args ...string) bool {
+	if len(args) != 2 {
+		usage := "usage: !pickmethod mode " + strings.Join(pickmethods, "|")
+		if initial {
+			log.Println(usage)
+		} else {
+			sayusage(where, who, usage)
+		}
+		return false
+	}
+	return modeset(where, who, args[0], "pick", args[1])
+}
+
+// Split players into nt teams at random.
+func randomteams(who []Player, nt int) [][]Player {
+	teams := make([][]Player, nt)
+	for i, j := range rand.Perm(len(who)) {
+		t := i % nt
+		teams[t] = append(teams[t], who[j])
+	}
+	return teams
+}
+
+// Split players into nt teams whose total ratings in mode differ the
+// least. Small games of two teams try every split; others are filled
+// greedily, best player first, into the weakest team with room.
+func balance(mode string, who []Player, nt int) [][]Player {
+	rs := make([]float64, len(who))
+	for i := range who {
+		rs[i] = rating(mode, playername(who[i].user))
+	}
+	teams := make([][]Player, nt)
+	n := len(who)
+	if nt != 2 || n > maxexhaustive {
+		idx := make([]int, n)
+		for i := range idx {
+			idx[i] = i
+		}
+		sort.Slice(idx, func(i, j int) bool { return rs[idx[i]] > rs[idx[j]] })
+		max := (n + nt - 1) / nt
+		sum := make([]float64, nt)
+		for _, i := range idx {
+			t := -1
+			for u := range teams {
+				if len(teams[u]) < max && (t < 0 || sum[u] < sum[t]) {
+					t = u
+				}
+			}
+			teams[t] = append(teams[t], who[i])
+			sum[t] += rs[i]
+		}
+		return teams
+	}
+	total := 0.0
+	for _, r := range rs {
+		total += r
+	}
+	best, bestdiff := uint(0), math.Inf(1)
+	for mask := uint(0); mask < 1<<uint(n); mask++ {
+		if bits.OnesCount(mask) != n/2 {
+			continue
+		}
+		sum := 0.0
+		for i := 0; i < n; i++ {
+			if mask&(1<<uint(i)) != 0 {
+				sum += rs[i]
+			}
+		}
+		if diff := math.Abs(total - 2*sum); diff < bestdiff {
+			best, bestdiff = mask, diff
+		}
+	}
+	for i := 0; i < n; i++ {
+		if best&(1<<uint(i)) != 0 {
+			teams[0] = append(teams[0], who[i])
+		} else {
+			teams[1] = append(teams[1], who[i])
+		}
+	}
+	return teams
+}
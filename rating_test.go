@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// The worked example from Glickman's Glicko-2 paper.
+func TestRatingUpdate(t *testing.T) {
+	rt := Rating{1500, 200, 0.06}
+	got := rt.update([]Rating{{1400, 30, 0.06}, {1550, 100, 0.06}, {1700, 300, 0.06}}, []float64{1, 0, 0})
+	want := Rating{1464.06, 151.52, 0.05999}
+	if math.Abs(got.r-want.r) > 0.01 || math.Abs(got.rd-want.rd) > 0.01 || math.Abs(got.vol-want.vol) > 0.00001 {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got := rt.update(nil, nil); got != rt {
+		t.Errorf("no games: got %+v", got)
+	}
+}
+
+func TestRategame(t *testing.T) {
+	for _, c := range []struct {
+		teams  [][]string
+		winner int
+		dir    []int // How each team's ratings move: 1 up, -1 down, 0 not at all.
+	}{
+		{[][]string{{"a", "b"}, {"c", "d"}}, 1, []int{1, -1}},
+		{[][]string{{"a", "b"}, {"c", "d"}}, 2, []int{-1, 1}},
+		{[][]string{{"a"}, {"b"}, {"c"}}, 3, []int{-1, -1, 1}},
+		{[][]string{{"a", "b"}, {"c", "d"}}, 0, []int{0, 0}},
+	} {
+		testbot(t)
+		ratings = make(map[string]map[string]Rating)
+		rategame("ctf", c.teams, c.winner)
+		for i, team := range c.teams {
+			for _, n := range team {
+				rt := getrating("ctf", n)
+				d := 0
+				switch {
+				case rt.r > defaultrating+0.01:
+					d = 1
+				case rt.r < defaultrating-0.01:
+					d = -1
+				}
+				if d != c.dir[i] || rt.rd >= defaultrd {
+					t.Errorf("%v, winner %d: %s rated %+v", c.teams, c.winner, n, rt)
+				}
+			}
+		}
+	}
+}
+
+func TestBalance(t *testing.T) {
+	for _, c := range []struct {
+		rs      []float64
+		nt      int
+		maxdiff float64
+	}{
+		{[]float64{2000, 1800, 1600, 1400}, 2, 0},
+		{[]float64{2100, 1500, 1500, 1500, 1500, 1100}, 2, 200},
+		{[]float64{1900, 1700, 1500, 1300, 1100, 900}, 3, 0},
+		{[]float64{1500, 1500, 1500, 1500, 1500}, 2, 1500},
+	} {
+		testbot(t)
+		ratings = make(map[string]map[string]Rating)
+		who := make([]Player, len(c.rs))
+		for i, r := range c.rs {
+			who[i].user = fmt.Sprintf("p%d!u@h", i)
+			putrating("ctf", fmt.Sprintf("p%d", i), Rating{r, 100, defaultvol})
+		}
+		teams := balance("ctf", who, c.nt)
+		lo, hi, n := math.Inf(1), math.Inf(-1), 0
+		for _, team := range teams {
+			sum := 0.0
+			for _, u := range team {
+				sum += rating("ctf", playername(u.user))
+			}
+			lo, hi, n = math.Min(lo, sum), math.Max(hi, sum), n+len(team)
+			if len(team) < len(c.rs)/c.nt || len(team) > (len(c.rs)+c.nt-1)/c.nt {
+				t.Errorf("%v in %d teams: uneven %v", c.rs, c.nt, teams)
+			}
+		}
+		if n != len(c.rs) || hi-lo > c.maxdiff {
+			t.Errorf("%v in %d teams: %v, %v apart", c.rs, c.nt, teams, hi-lo)
+		}
+	}
+}
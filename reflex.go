@@ -283,6 +283,14 @@ func (srv *ReflexServer) host() string {
 	return srv.rhost
 }
 
+func (srv *ReflexServer) kind() string {
+	return "reflex"
+}
+
+func (srv *ReflexServer) addr() string {
+	return srv.rhost + ":" + srv.steamport
+}
+
 func (srv *ReflexServer) hostname() string {
 	return srv.rhostname
 }
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const resultsfile = "pickupresults.log"
+
+func (g *Game) names(team int) []string {
+	var names []string
+	for _, u := range g.who {
+		if u.team == team {
+			names = append(names, playername(u.user))
+		}
+	}
+	return names
+}
+
+// The winner agreed on by all the captains or by more than half of
+// the players, if any.
+func (g *Game) agreed() (int, bool) {
+	count := make(map[int]int)
+	capvotes := make(map[int]int)
+	for _, u := range g.who {
+		nick, _, _ := splituserstring(u.user)
+		w, ok := g.votes[u.user]
+		if !ok {
+			continue
+		}
+		count[w]++
+		for _, c := range g.caps {
+			if nick == c {
+				capvotes[w]++
+			}
+		}
+	}
+	for w, n := range capvotes {
+		if n == len(g.caps) {
+			return w, true
+		}
+	}
+	for w, n := range count {
+		if 2*n > len(g.who) {
+			return w, true
+		}
+	}
+	return 0, false
+}
+
+// Record the result, rate the players and finish the game.
+func (g *Game) settle(winner int) {
+	g.state = Finished
+	g.reported = true
+	g.winner = winner
+	teams := make([][]string, len(g.teamnames))
+	for t := range teams {
+		teams[t] = g.names(t + 1)
+	}
+	rategame(g.name, teams, winner)
+	if err := appendresult(resultsfile, g, winner, teams); err != nil {
+		log.Println(err)
+	}
+	err := hist.edit(g.id, func(h *HistVal) bool {
+		switch {
+		case winner == 0:
+			h.result = "draw"
+		case h.team == winner:
+			h.result = "win"
+		default:
+			h.result = "loss"
+		}
+		h.length = time.Since(h.t).Round(time.Second)
+		return true
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	s := csprintf("{orange}{b}%s{b} game #%d{r} was a draw", g.name, g.id)
+	if winner != 0 {
+		s = csprintf("{orange}{b}%s{b} game #%d{r} was won by %s: %s",
+			g.name, g.id, g.teamname(winner), teamcolour(winner, strings.Join(teams[winner-1], " ")))
+	}
+	irc.privmsg(channel, s)
+	if g.ladder {
+		ladderresult(g, winner)
+	}
+	if g.cupmatch != nil {
+		g.cupmatch.settle(winner)
+	}
+}
+
+// Log a result as the time, game ID, mode, winning team (0 for a draw)
+// and each team's players.
+func appendresult(fname string, g *Game, winner int, teams [][]string) error {
+	f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	t := time.Now().Format(tlayout)
+	ss := []string{t, strconv.Itoa(g.id), g.name, strconv.Itoa(winner)}
+	for _, team := range teams {
+		ss = append(ss, strings.Join(team, ","))
+	}
+	_, err = fmt.Fprintln(f, strings.Join(ss, "\t"))
+	return err
+}
+
+func report(where, who string, args ...string) bool {
+	usage := "usage: !report [id] win|loss|draw|team"
+	if len(args) < 1 || len(args) > 2 {
+		sayusage(where, who, usage)
+		return false
+	}
+	id := 0
+	if len(args) == 2 {
+		var err error
+		if id, err = strconv.Atoi(strings.TrimPrefix(args[0], "#")); err != nil {
+			sayusage(where, who, usage)
+			return false
+		}
+	}
+	op := irc.isopped(who, channel)
+	var g *Game
+	for i := len(games) - 1; i >= 0 && g == nil; i-- {
+		gg := games[i]
+		if gg.state != Playing || !gg.teamgame() {
+			continue
+		}
+		if (id == 0 || gg.id == id) && (op || gg.team(who) != 0) {
+			g = gg
+		}
+	}
+	if g == nil {
+		sayusage(where, who, "no such game awaiting a result")
+		return false
+	}
+	// Ops who didn't play report from the first team's view.
+	team := g.team(who)
+	if team == 0 {
+		team = 1
+	}
+	winner := -1
+	switch res := args[len(args)-1]; strings.ToLower(res) {
+	case "win":
+		winner = team
+	case "loss":
+		if len(g.teamnames) != 2 {
+			sayusage(where, who, "name the winning team")
+			return false
+		}
+		winner = 3 - team
+	case "draw":
+		winner = 0
+	default:
+		for t, name := range g.teamnames {
+			if strings.EqualFold(name, res) {
+				winner = t + 1
+			}
+		}
+	}
+	if winner < 0 {
+		sayusage(where, who, usage)
+		return false
+	}
+	if winner == 0 && g.cupmatch != nil {
+		sayusage(where, who, "cup matches can't be drawn")
+		return false
+	}
+	if op {
+		g.settle(winner)
+		return true
+	}
+	g.votes[who] = winner
+	if w, ok := g.agreed(); ok {
+		g.settle(w)
+		return true
+	}
+	say(where, who, fmt.Sprintf("result noted for %s game #%d", g.name, g.id))
+	return true
+}
+
+func showrating(where, who string, args ...string) bool {
+	if len(args) > 2 {
+		sayusage(where, who, "usage: !rating [nick] [mode]")
+		return false
+	}
+	name := playername(who)
+	var mode string
+	switch {
+	case len(args) == 2:
+		name, mode = strings.Trim(args[0], "`^_"), args[1]
+	case len(args) == 1 && modes[strings.ToLower(args[0])] != nil:
+		mode = args[0]
+	case len(args) == 1:
+		name = strings.Trim(args[0], "`^_")
+	}
+	if mode != "" {
+		rt := getrating(mode, name)
+		say(where, who, fmt.Sprintf("%s in %s: %.0f (±%.0f)", name, mode, rt.r, 2*rt.rd))
+		return true
+	}
+	var ss []string
+	for k, rs := range ratings {
+		if rt, ok := rs[strings.ToLower(name)]; ok {
+			ss = append(ss, fmt.Sprintf("%s %.0f (±%.0f)", k, rt.r, 2*rt.rd))
+		}
+	}
+	if len(ss) == 0 {
+		say(where, who, fmt.Sprintf("%s is unrated", name))
+		return true
+	}
+	sort.Strings(ss)
+	say(where, who, fmt.Sprintf("%s: %s", name, strings.Join(ss, ", ")))
+	return true
+}
+
+func leaderboard(where, who string, args ...string) bool {
+	if len(args) != 1 {
+		sayusage(where, who, "usage: !leaderboard mode")
+		return false
+	}
+	type entry struct {
+		name string
+		rt   Rating
+	}
+	var top []entry
+	for name, rt := range ratings[strings.ToLower(args[0])] {
+		top = append(top, entry{name, rt})
+	}
+	// Rank by the rating we're fairly sure the player has beaten.
+	sort.Slice(top, func(i, j int) bool {
+		a, b := top[i].rt.r-2*top[i].rt.rd, top[j].rt.r-2*top[j].rt.rd
+		if a != b {
+			return a > b
+		}
+		return top[i].name < top[j].name
+	})
+	if len(top) > 10 {
+		top = top[:10]
+	}
+	ss := make([]string, len(top))
+	for i := range top {
+		ss[i] = fmt.Sprintf("%s (%.0f)", top[i].name, top[i].rt.r)
+	}
+	say(where, who, fmt.Sprintf("top %s players: %s", args[0], strings.Join(ss, ", ")))
+	return true
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // For zones on systems without a zone database.
+)
+
+// A pickup planned for a time, which players may sign up for ahead.
+type Scheduled struct {
+	id       int
+	mode     string
+	t        time.Time // In the zone it was scheduled in, so weekly events keep their local time.
+	weekly   bool      // Does it recur every week?
+	signups  []string  // Players signed up.
+	reminded int       // Reminders sent or skipped, as an index into reminders.
+}
+
+const (
+	schedulefile = "pickupschedule.log"
+	zonesfile    = "pickupzones.log"
+	timeformat   = "Mon 2 Jan 15:04 MST"
+)
+
+var (
+	events    []*Scheduled
+	nextevent = 1
+	reminders = []time.Duration{time.Hour, 10 * time.Minute} // Lead times, longest first.
+	zones     = make(map[string]*time.Location)              // Chosen zones by player name.
+	deftz     = time.Local                                   // Zone for the channel.
+)
+
+// The zone who chose with !timezone, or the channel's.
+func zonefor(who string) *time.Location {
+	if loc, ok := zones[strings.ToLower(playername(who))]; ok {
+		return loc
+	}
+	return deftz
+}
+
+func sortevents() {
+	sort.SliceStable(events, func(i, j int) bool { return events[i].t.Before(events[j].t) })
+}
+
+func findevent(id int) *Scheduled {
+	for _, e := range events {
+		if e.id == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// The event id names, or the next one if id is "".
+func pickevent(id string) *Scheduled {
+	if id == "" {
+		if len(events) == 0 {
+			return nil
+		}
+		return events[0]
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(id, "#"))
+	if err != nil {
+		return nil
+	}
+	return findevent(n)
+}
+
+// The event as shown to who, in their zone.
+func (e *Scheduled) describe(loc *time.Location) string {
+	s := csprintf("{orange}#%d {b}%s{b}{r} %s", e.id, e.mode, e.t.In(loc).Format(timeformat))
+	if e.weekly {
+		s += " weekly"
+	}
+	if len(e.signups) > 0 {
+		nicks := make([]string, len(e.signups))
+		for i, u := range e.signups {
+			nicks[i], _, _ = splituserstring(u)
+		}
+		s += fmt.Sprintf(" (%d signed up: %s)", len(nicks), strings.Join(nicks, " "))
+	}
+	return s
+}
+
+// For the topic: the next event, if any.
+func nexteventstring() string {
+	if len(events) == 0 {
+		return ""
+	}
+	e := events[0]
+	return csprintf("{red}{b}%s{b}{r} %s", e.mode, e.t.In(deftz).Format("Mon 15:04 MST"))
+}
+
+func schedule(where, who string, args ...string) bool {
+	if len(args) == 0 {
+		if len(events) == 0 {
+			say(where, who, "no pickups scheduled")
+			return true
+		}
+		loc := zonefor(who)
+		for _, e := range events {
+			say(where, who, e.describe(loc))
+			time.Sleep(60 * time.Millisecond)
+		}
+		return true
+	}
+	if !irc.isopped(who, channel) {
+		sayusage(where, who, "only operators may schedule pickups")
+		return false
+	}
+	usage := "usage: !schedule [mode yyyy-mm-dd hh:mm [zone] [weekly]]"
+	if len(args) < 3 {
+		sayusage(where, who, usage)
+		return false
+	}
+	m, ok := modes[strings.ToLower(args[0])]
+	if !ok {
+		sayusage(where, who, fmt.Sprintf("%s: no such mode", args[0]))
+		return false
+	}
+	loc := zonefor(who)
+	weekly := false
+	for _, a := range args[3:] {
+		switch strings.ToLower(a) {
+		case "weekly":
+			weekly = true
+		case "recurring":
+		default:
+			l, err := time.LoadLocation(a)
+			if err != nil {
+				sayusage(where, who, fmt.Sprintf("%s: unknown time zone", a))
+				return false
+			}
+			loc = l
+		}
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04", args[1]+" "+args[2], loc)
+	if err != nil {
+		sayusage(where, who, usage)
+		return false
+	}
+	if !t.After(time.Now()) {
+		sayusage(where, who, "that time has passed")
+		return false
+	}
+	e := &Scheduled{id: nextevent, mode: m.name, t: t, weekly: weekly}
+	nextevent++
+	e.skipreminders()
+	events = append(events, e)
+	sortevents()
+	writeevents(schedulefile)
+	broadcast(csprintf("{pink}{b}%s{b} pickup scheduled for %s; say {b}!signup %d{b} in {b}%s{b} to play!",
+		e.mode, e.t.In(deftz).Format(timeformat), e.id, channel))
+	updatetopic()
+	return true
+}
+
+// Don't send reminders whose lead time had already passed when the
+// event was scheduled.
+func (e *Scheduled) skipreminders() {
+	for e.reminded < len(reminders) && time.Until(e.t) <= reminders[e.reminded] {
+		e.reminded++
+	}
+}
+
+func unschedule(where, who string, args ...string) bool {
+	if len(args) != 1 {
+		sayusage(where, who, "usage: !unschedule id")
+		return false
+	}
+	e := pickevent(args[0])
+	if e == nil {
+		sayusage(where, who, fmt.Sprintf("%s: no such event", args[0]))
+		return false
+	}
+	removeevent(e)
+	writeevents(schedulefile)
+	say(where, who, fmt.Sprintf("cancelled %s pickup #%d", e.mode, e.id))
+	updatetopic()
+	return true
+}
+
+func removeevent(e *Scheduled) {
+	for i := range events {
+		if events[i] == e {
+			events = append(events[:i], events[i+1:]...)
+			return
+		}
+	}
+}
+
+func signup(where, who string, args ...string) bool {
+	if len(args) > 1 {
+		sayusage(where, who, "usage: !signup [id]")
+		return false
+	}
+	id := ""
+	if len(args) == 1 {
+		id = args[0]
+	}
+	e := pickevent(id)
+	if e == nil {
+		sayusage(where, who, "no such event")
+		return false
+	}
+	if checkban(where, who) {
+		return false
+	}
+	for _, u := range e.signups {
+		if u == who {
+			sayusage(where, who, "you have already signed up")
+			return false
+		}
+	}
+	e.signups = append(e.signups, who)
+	writeevents(schedulefile)
+	say(where, who, "signed up for "+e.describe(zonefor(who)))
+	return true
+}
+
+func unsignup(where, who string, args ...string) bool {
+	for _, e := range events {
+		if len(args) > 0 && strconv.Itoa(e.id) != strings.TrimPrefix(args[0], "#") {
+			continue
+		}
+		for i, u := range e.signups {
+			if u == who {
+				e.signups = append(e.signups[:i], e.signups[i+1:]...)
+				writeevents(schedulefile)
+				say(where, who, fmt.Sprintf("you are no longer signed up for %s #%d", e.mode, e.id))
+				return true
+			}
+		}
+	}
+	sayusage(where, who, "you aren't signed up for that")
+	return false
+}
+
+// Send reminders that are due and open events whose time has come,
+// adding their signed-up players to the mode.
+func chkschedule() {
+	changed := false
+	for _, e := range events {
+		i := e.reminded
+		e.skipreminders()
+		if e.reminded > i && time.Until(e.t) > 0 {
+			changed = true
+			broadcast(csprintf("{pink}{b}%s{b} pickup in %v, at %s; %d signed up, say {b}!signup %d{b} in {b}%s{b} to play!",
+				e.mode, time.Until(e.t).Round(time.Minute), e.t.In(deftz).Format(timeformat),
+				len(e.signups), e.id, channel))
+		}
+	}
+	for len(events) > 0 && !events[0].t.After(time.Now()) {
+		e := events[0]
+		e.open()
+		removeevent(e)
+		if e.weekly {
+			for !e.t.After(time.Now()) {
+				e.t = e.t.AddDate(0, 0, 7)
+			}
+			e.signups = nil
+			e.reminded = 0
+			e.skipreminders()
+			events = append(events, e)
+			sortevents()
+		}
+		changed = true
+	}
+	if changed {
+		writeevents(schedulefile)
+		updatetopic()
+	}
+}
+
+// Add the signed-up players to the event's mode.
+func (e *Scheduled) open() {
+	m, ok := modes[strings.ToLower(e.mode)]
+	if !ok {
+		return
+	}
+	var nicks []string
+	now := time.Now()
+	for _, u := range e.signups {
+		if findban(u) != nil || findgame(u, "") != nil {
+			continue
+		}
+		if m.addplayer(u, now) {
+			nick, _, _ := splituserstring(u)
+			nicks = append(nicks, nick)
+		}
+	}
+	broadcast(csprintf("{pink}{b}%s{b} pickup is open: %s [%d/%d]; !add %s to play!",
+		m.name, strings.Join(nicks, " "), len(m.who), m.nneeded, m.name))
+	startfull()
+	autopromote()
+}
+
+// Show the lead times of reminders before scheduled pickups, or set
+// them, or with "none", stop sending reminders.
+func setreminders(where, who string, args ...string) bool {
+	if len(args) == 0 {
+		ss := make([]string, len(reminders))
+		for i, d := range reminders {
+			ss[i] = d.String()
+		}
+		if len(ss) == 0 {
+			ss = []string{"none"}
+		}
+		say(where, who, "reminders: "+strings.Join(ss, " "))
+		return false // Nothing to save.
+	}
+	var ds []time.Duration
+	if len(args) != 1 || strings.ToLower(args[0]) != "none" {
+		for _, a := range args {
+			d, err := parseduration(a)
+			if err != nil || d <= 0 {
+				usage := "usage: !reminders [duration ... (e.g. 1d 1h 10m) | none]"
+				if initial {
+					log.Println(usage)
+				} else {
+					sayusage(where, who, usage)
+				}
+				return false
+			}
+			ds = append(ds, d)
+		}
+	}
+	putreminders(ds)
+	return true
+}
+
+// Use ds as the reminder lead times.
+func putreminders(ds []time.Duration) {
+	sort.Slice(ds, func(i, j int) bool { return ds[i] > ds[j] })
+	reminders = ds
+	for _, e := range events {
+		e.reminded = 0
+		e.skipreminders()
+	}
+}
+
+func settimezone(where, who string, args ...string) bool {
+	name := strings.ToLower(playername(who))
+	if len(args) == 0 {
+		say(where, who, "your time zone is "+zonefor(who).String())
+		return true
+	}
+	if len(args) != 1 {
+		sayusage(where, who, "usage: !timezone [zone] (e.g. Europe/London, America/New_York)")
+		return false
+	}
+	loc, err := time.LoadLocation(args[0])
+	if err != nil {
+		sayusage(where, who, fmt.Sprintf("%s: unknown time zone", args[0]))
+		return false
+	}
+	zones[name] = loc
+	if err := writezones(zonesfile); err != nil {
+		log.Println(err)
+	}
+	say(where, who, "your time zone is now "+loc.String())
+	return true
+}
+
+func readevents(fname string) error {
+	f, err := os.OpenFile(fname, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewScanner(f)
+	for r.Scan() {
+		ss := strings.Split(r.Text(), "\t")
+		if len(ss) != 7 {
+			log.Println("bad entry in schedule")
+			continue
+		}
+		id, err1 := strconv.Atoi(ss[0])
+		t, err2 := time.Parse(time.RFC3339, ss[2])
+		n, err3 := strconv.Atoi(ss[4])
+		if err1 != nil || err2 != nil || err3 != nil {
+			log.Println("bad entry in schedule")
+			continue
+		}
+		if loc, err := time.LoadLocation(ss[6]); err == nil {
+			t = t.In(loc)
+		}
+		e := &Scheduled{id: id, mode: ss[1], t: t, weekly: ss[3] == "weekly", reminded: n}
+		if ss[5] != "" {
+			e.signups = strings.Split(ss[5], ",")
+		}
+		events = append(events, e)
+		if id >= nextevent {
+			nextevent = id + 1
+		}
+	}
+	sortevents()
+	return r.Err()
+}
+
+func writeevents(fname string) {
+	err := writeatomic(fname, func(w *bufio.Writer) error {
+		for _, e := range events {
+			weekly := "once"
+			if e.weekly {
+				weekly = "weekly"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%s\t%s\n", e.id, e.mode, e.t.Format(time.RFC3339),
+				weekly, e.reminded, strings.Join(e.signups, ","), e.t.Location())
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func readzones(fname string) error {
+	f, err := os.OpenFile(fname, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewScanner(f)
+	for r.Scan() {
+		ss := strings.Split(r.Text(), "\t")
+		if len(ss) != 2 {
+			log.Println("bad entry in time zones")
+			continue
+		}
+		loc, err := time.LoadLocation(ss[1])
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		zones[ss[0]] = loc
+	}
+	return r.Err()
+}
+
+func writezones(fname string) error {
+	return writeatomic(fname, func(w *bufio.Writer) error {
+		for name, loc := range zones {
+			fmt.Fprintf(w, "%s\t%s\n", name, loc)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetreminders(t *testing.T) {
+	testbot(t)
+	saved := reminders
+	t.Cleanup(func() { reminders = saved })
+	for _, c := range []struct {
+		args []string
+		ok   bool
+		want string // The reminders after.
+		said string
+	}{
+		{[]string{"30m", "2h"}, true, "[2h0m0s 30m0s]", ""},
+		{nil, false, "[2h0m0s 30m0s]", "reminders: 2h0m0s 30m0s"},
+		{[]string{"1h", "soon"}, false, "[2h0m0s 30m0s]", "usage"},
+		{[]string{"None"}, true, "[]", ""},
+		{nil, false, "[]", "reminders: none"},
+	} {
+		for len(irc.out) > 0 {
+			<-irc.out
+		}
+		ok := setreminders("#pickup", "op!u@h", c.args...)
+		said := ""
+		if len(irc.out) > 0 {
+			said = <-irc.out
+		}
+		if ok != c.ok || fmt.Sprint(reminders) != c.want || !strings.Contains(said, c.said) {
+			t.Errorf("!reminders %q: %t, %v, said %q", c.args, ok, reminders, said)
+		}
+	}
+	if err := (&Config{Reminders: []string{}}).apply(); err != nil || len(reminders) != 0 {
+		t.Errorf("empty reminders in the config: %v, %v", reminders, err)
+	}
+	if err := (&Config{Reminders: []string{"10m"}}).apply(); err != nil || len(reminders) != 1 || reminders[0] != 10*time.Minute {
+		t.Errorf("reminders in the config: %v, %v", reminders, err)
+	}
+}
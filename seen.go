@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// When a player was last about.
+type Seen struct {
+	said  time.Time // Last seen in the channel.
+	doing string    // What they were doing then, e.g. "joining".
+	added time.Time // Last !add.
+}
+
+const (
+	seenfile     = "pickupseen.log"
+	defhistory   = 5  // Games shown by !history.
+	maxhistory   = 10 // Most games !history will show.
+	seentimefmt  = "Mon 2 Jan 2006 15:04 MST"
+	historyshown = "Mon 2 Jan 15:04"
+)
+
+var (
+	seen      = make(map[string]*Seen) // By lower-cased player name.
+	seendirty bool                     // Changed since last written?
+)
+
+func seenby(name string) *Seen {
+	k := strings.ToLower(name)
+	s, ok := seen[k]
+	if !ok {
+		s = &Seen{}
+		seen[k] = s
+	}
+	seendirty = true
+	return s
+}
+
+// Note what the source of ev was doing in the channel.
+func noteseen(ev Event) {
+	if ev.nick == "" {
+		return
+	}
+	var doing string
+	switch ev.cmd {
+	case "privmsg", "join", "part":
+		// A plain JOIN has the channel as its message.
+		where := ev.msg
+		if len(ev.args) > 0 {
+			where = ev.args[0]
+		}
+		if !strings.EqualFold(where, channel) {
+			return
+		}
+		doing = map[string]string{"privmsg": "talking", "join": "joining", "part": "leaving"}[ev.cmd]
+	case "quit":
+		doing = "quitting"
+	case "nick":
+		doing = "changing nick to " + ev.msg
+		s := seenby(strings.Trim(ev.msg, "`^_"))
+		s.said, s.doing = time.Now(), "changing nick from "+ev.nick
+	default:
+		return
+	}
+	s := seenby(playername(ev.src))
+	s.said, s.doing = time.Now(), doing
+}
+
+func noteadd(who string) {
+	seenby(playername(who)).added = time.Now()
+}
+
+// How long ago t was, roughly.
+func ago(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh %dm ago", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return fmt.Sprintf("%dd %dh ago", int(d.Hours())/24, int(d.Hours())%24)
+}
+
+func showseen(where, who string, args ...string) bool {
+	if len(args) != 1 {
+		sayusage(where, who, "usage: !seen nick")
+		return false
+	}
+	name := strings.Trim(args[0], "`^_")
+	loc := zonefor(who)
+	var ss []string
+	if hs := hist.player(name); len(hs) > 0 {
+		h := hs[len(hs)-1]
+		game := h.mode
+		if h.id != 0 {
+			game += fmt.Sprintf(" #%d", h.id)
+		}
+		ss = append(ss, fmt.Sprintf("last played %s %s (%s)", game, ago(h.t), h.t.In(loc).Format(seentimefmt)))
+	}
+	if s, ok := seen[strings.ToLower(name)]; ok {
+		if !s.added.IsZero() {
+			ss = append(ss, "last added "+ago(s.added))
+		}
+		if !s.said.IsZero() {
+			ss = append(ss, fmt.Sprintf("last seen in %s %s, %s", channel, ago(s.said), s.doing))
+		}
+	}
+	if len(ss) == 0 {
+		say(where, who, fmt.Sprintf("I haven't seen %s", name))
+		return true
+	}
+	say(where, who, csprintf("{orange}{b}%s{b}{r}: %s", name, strings.Join(ss, "; ")))
+	return true
+}
+
+func showhistory(where, who string, args ...string) bool {
+	usage := "usage: !history [mode] [n]"
+	mode, n := "", defhistory
+	for _, a := range args {
+		if i, err := strconv.Atoi(a); err == nil {
+			if i < 1 || i > maxhistory {
+				sayusage(where, who, fmt.Sprintf("n must be from 1 to %d", maxhistory))
+				return false
+			}
+			n = i
+		} else if mode == "" {
+			mode = a
+		} else {
+			sayusage(where, who, usage)
+			return false
+		}
+	}
+	// Gather the latest games, newest first. Old entries without a game
+	// ID are taken to be from the same game if they have the same mode
+	// and time.
+	var recent [][]HistVal
+	for i := len(hist.recs) - 1; i >= 0 && len(recent) <= n; i-- {
+		h := hist.recs[i]
+		if mode != "" && !strings.EqualFold(h.mode, mode) {
+			continue
+		}
+		if k := len(recent) - 1; k >= 0 && samegame(recent[k][0], h) {
+			recent[k] = append(recent[k], h)
+			continue
+		}
+		recent = append(recent, []HistVal{h})
+	}
+	if len(recent) > n {
+		recent = recent[:n]
+	}
+	if len(recent) == 0 {
+		say(where, who, "no games")
+		return true
+	}
+	loc := zonefor(who)
+	for _, hs := range recent {
+		say(where, who, histstring(hs, loc))
+		time.Sleep(60 * time.Millisecond)
+	}
+	return true
+}
+
+func samegame(a, b HistVal) bool {
+	if a.id != 0 || b.id != 0 {
+		return a.id == b.id
+	}
+	return a.mode == b.mode && a.t.Equal(b.t)
+}
+
+// A game from its history entries, which are newest first.
+func histstring(hs []HistVal, loc *time.Location) string {
+	h := hs[0]
+	s := csprintf("{orange}{b}%s{b}", h.mode)
+	if h.id != 0 {
+		s += fmt.Sprintf(" #%d", h.id)
+	}
+	s += csprintf("{r} %s", h.t.In(loc).Format(historyshown))
+	if h.server != "" {
+		s += " on " + h.server
+	}
+	if h.mapname != "" {
+		s += csprintf(" ({b}%s{b})", h.mapname)
+	}
+	var teams [][]string
+	var winner int
+	for i := len(hs) - 1; i >= 0; i-- {
+		t := hs[i].team
+		for len(teams) <= t {
+			teams = append(teams, nil)
+		}
+		teams[t] = append(teams[t], hs[i].nick)
+		if hs[i].result == "win" {
+			winner = t
+		}
+	}
+	if len(teams) == 1 {
+		return s + ": " + strings.Join(teams[0], " ")
+	}
+	var ts []string
+	for t := 1; t < len(teams); t++ {
+		ts = append(ts, teamcolour(t, strings.Join(teams[t], " ")))
+	}
+	s += ": " + strings.Join(ts, " vs ")
+	switch {
+	case winner != 0:
+		s += " || won by " + teamcolour(winner, strings.Join(teams[winner], " "))
+	case h.result == "draw":
+		s += " || draw"
+	}
+	return s
+}
+
+func readseen(fname string) error {
+	f, err := os.OpenFile(fname, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewScanner(f)
+	for r.Scan() {
+		ss := strings.Split(r.Text(), "\t")
+		if len(ss) != 4 {
+			log.Println("bad entry in seen")
+			continue
+		}
+		s := &Seen{doing: ss[2]}
+		s.said, _ = time.Parse(time.RFC3339, ss[1])
+		s.added, _ = time.Parse(time.RFC3339, ss[3])
+		seen[ss[0]] = s
+	}
+	return r.Err()
+}
+
+// Rewrite the seen file if anything has changed.
+func writeseen(fname string) {
+	if !seendirty {
+		return
+	}
+	err := writeatomic(fname, func(w *bufio.Writer) error {
+		for k, s := range seen {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", k, s.said.Format(time.RFC3339), s.doing, s.added.Format(time.RFC3339))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	seendirty = false
+}
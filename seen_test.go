@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// What players were doing in the channel survives a restart, and
+// nick changes are noted under both names.
+func TestSeen(t *testing.T) {
+	testbot(t)
+	seen = make(map[string]*Seen)
+	noteseen(Event{cmd: "privmsg", nick: "Alice", src: "Alice!u@h", args: []string{"#pickup"}, msg: "hi"})
+	noteseen(Event{cmd: "privmsg", nick: "bob", src: "bob!u@h", args: []string{"#other"}, msg: "hi"})
+	noteseen(Event{cmd: "nick", nick: "carol", src: "carol!u@h", msg: "dan"})
+	noteadd("Alice!u@h")
+	writeseen(seenfile)
+	seen = make(map[string]*Seen)
+	if err := readseen(seenfile); err != nil {
+		t.Fatal(err)
+	}
+	if s := seen["alice"]; s == nil || s.doing != "talking" || s.added.IsZero() {
+		t.Errorf("alice: %+v", s)
+	}
+	if s := seen["bob"]; s != nil {
+		t.Errorf("bob seen elsewhere: %+v", s)
+	}
+	if s := seen["carol"]; s == nil || s.doing != "changing nick to dan" {
+		t.Errorf("carol: %+v", s)
+	}
+	if s := seen["dan"]; s == nil || s.doing != "changing nick from carol" {
+		t.Errorf("dan: %+v", s)
+	}
+}
+
+// !history shows the newest games first, grouping old entries without
+// IDs by mode and time.
+func TestHistory(t *testing.T) {
+	testbot(t)
+	now := time.Now().Truncate(time.Minute)
+	err := hist.add([]HistVal{
+		{t: now.Add(-2 * time.Hour), mode: "ctf", nick: "alice"},
+		{t: now.Add(-2 * time.Hour), mode: "ctf", nick: "bob"},
+		{v: histversion, t: now.Add(-time.Hour), mode: "ctf", nick: "carol", team: 1, id: 7, result: "win"},
+		{v: histversion, t: now.Add(-time.Hour), mode: "ctf", nick: "dave", team: 2, id: 7, result: "loss"},
+		{v: histversion, t: now, mode: "duel", nick: "erin", team: 1, id: 8},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	showhistory("#pickup", "alice!u@h", "ctf")
+	var out []string
+	for len(irc.out) > 0 {
+		out = append(out, <-irc.out)
+	}
+	if len(out) != 2 || !strings.Contains(out[0], "#7") || !strings.Contains(out[0], "won by") ||
+		!strings.Contains(out[1], "alice bob") {
+		t.Errorf("history: %q", out)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The snapshot of live state: the players added to each mode, recent
+// games with their map votes, cups and the next game ID, so that a
+// restart loses none of them.
+const statefile = "pickupstate.log"
+
+var (
+	laststate    []byte   // The snapshot last written.
+	restorenotes []string // What a restart lost, to tell the channel.
+)
+
+// The live state, one entry per line:
+//
+//	next	id
+//	player	mode	user	expire	added	captain	warned
+//	game	id	mode	started	state	reported	winner	server	map	ladder	teamnames	caps	needsub
+//	gameplayer	id	user	team	captain
+//	gameprev	id	mode	user	expire	added	captain	warned
+//	mapvote	id	choices
+//	mapvoter	id	user	choice
+//	cup	name	mode	size	double	seeding	started	champion	entrants
+//	cupmatch	cup	num	winner	game	held	user	done	user	done
+//
+// The players before an active game started are kept for !abort.
+func snapshot() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "next\t%d\n", nextgameid)
+	ks := make([]string, 0, len(modes))
+	for k := range modes {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	for _, k := range ks {
+		for _, p := range modes[k].who {
+			fmt.Fprintf(&b, "player\t%s\t%s\t%s\t%s\t%t\t%t\n", k, p.user,
+				p.expire.Format(time.RFC3339), p.added.Format(time.RFC3339Nano), p.captain, p.warned)
+		}
+	}
+	for _, g := range games {
+		srv := ""
+		if g.srv != nil {
+			srv = g.srv.alias()
+		}
+		fmt.Fprintf(&b, "game\t%d\t%s\t%s\t%s\t%t\t%d\t%s\t%s\t%t\t%s\t%s\t%s\n", g.id, g.name,
+			g.started.Format(time.RFC3339), g.state, g.reported, g.winner, srv, g.mapname, g.ladder,
+			strings.Join(g.teamnames, ","), strings.Join(g.caps, ","), strings.Join(g.needsub, ","))
+		for _, p := range g.who {
+			fmt.Fprintf(&b, "gameplayer\t%d\t%s\t%d\t%t\n", g.id, p.user, p.team, p.captain)
+		}
+		if g.active() {
+			ks := make([]string, 0, len(g.prev))
+			for k := range g.prev {
+				ks = append(ks, k)
+			}
+			sort.Strings(ks)
+			for _, k := range ks {
+				for _, p := range g.prev[k] {
+					fmt.Fprintf(&b, "gameprev\t%d\t%s\t%s\t%s\t%s\t%t\t%t\n", g.id, k, p.user,
+						p.expire.Format(time.RFC3339), p.added.Format(time.RFC3339Nano), p.captain, p.warned)
+				}
+			}
+		}
+		if v := g.vote; v != nil {
+			fmt.Fprintf(&b, "mapvote\t%d\t%s\n", g.id, strings.Join(v.choices, ","))
+			us := make([]string, 0, len(v.votes))
+			for u := range v.votes {
+				us = append(us, u)
+			}
+			sort.Strings(us)
+			for _, u := range us {
+				fmt.Fprintf(&b, "mapvoter\t%d\t%s\t%d\n", g.id, u, v.votes[u])
+			}
+		}
+	}
+	for _, c := range cups {
+		if c.cancelled {
+			continue
+		}
+		fmt.Fprintf(&b, "cup\t%s\t%s\t%d\t%t\t%s\t%t\t%s\t%s\n", c.name, c.mode.name, c.size,
+			c.double, c.seeding, c.started, c.champion, strings.Join(c.who, ","))
+		for _, m := range c.matches {
+			id := 0
+			if m.game != nil {
+				id = m.game.id
+			}
+			fmt.Fprintf(&b, "cupmatch\t%s\t%d\t%d\t%d\t%t\t%s\t%t\t%s\t%t\n", c.name, m.num, m.winner, id,
+				m.held, m.slots[0].user, m.slots[0].done, m.slots[1].user, m.slots[1].done)
+		}
+	}
+	return b.Bytes()
+}
+
+// Write the snapshot if the state has changed since it was last
+// written.
+func savestate() {
+	s := snapshot()
+	if bytes.Equal(s, laststate) {
+		return
+	}
+	err := writeatomic(statefile, func(w *bufio.Writer) error {
+		_, err := w.Write(s)
+		return err
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	laststate = s
+}
+
+// Restore the snapshot, dropping players who have expired or whose mode
+// is gone. Drafts can't be resumed, so their players are put back in
+// their mode's queue to start it again, and the channel is told once
+// the bot is back.
+func readstate(fname string) error {
+	f, err := os.OpenFile(fname, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	now := time.Now()
+	var restored []*Game
+	byid := make(map[int]*Game)
+	var matches [][]string
+	r := bufio.NewScanner(f)
+	for r.Scan() {
+		ss := strings.Split(r.Text(), "\t")
+		switch {
+		case ss[0] == "next" && len(ss) == 2:
+			if n, err := strconv.Atoi(ss[1]); err == nil && n > nextgameid {
+				nextgameid = n
+			}
+		case ss[0] == "player" && len(ss) == 7:
+			m, ok := modes[ss[1]]
+			expire, err1 := time.Parse(time.RFC3339, ss[3])
+			added, err2 := time.Parse(time.RFC3339Nano, ss[4])
+			if !ok || err1 != nil || err2 != nil || !now.Before(expire) ||
+				findplayer(m.who, ss[2]) >= 0 {
+				continue
+			}
+			m.who = append(m.who, Player{user: ss[2], expire: expire, added: added,
+				captain: ss[5] == "true", warned: ss[6] == "true"})
+		case ss[0] == "game" && len(ss) == 13:
+			g := restoregame(ss[1:])
+			if g == nil {
+				log.Println("bad game in state")
+				continue
+			}
+			restored = append(restored, g)
+			byid[g.id] = g
+		case ss[0] == "gameplayer" && len(ss) == 5:
+			id, _ := strconv.Atoi(ss[1])
+			team, _ := strconv.Atoi(ss[3])
+			if g, ok := byid[id]; ok {
+				g.who = append(g.who, Player{user: ss[2], team: team, captain: ss[4] == "true"})
+			}
+		case ss[0] == "gameprev" && len(ss) == 8:
+			id, _ := strconv.Atoi(ss[1])
+			expire, err1 := time.Parse(time.RFC3339, ss[4])
+			added, err2 := time.Parse(time.RFC3339Nano, ss[5])
+			if g, ok := byid[id]; ok && err1 == nil && err2 == nil {
+				g.prev[ss[2]] = append(g.prev[ss[2]], Player{user: ss[3], expire: expire, added: added,
+					captain: ss[6] == "true", warned: ss[7] == "true"})
+			}
+		case ss[0] == "mapvote" && len(ss) == 3:
+			id, _ := strconv.Atoi(ss[1])
+			if g, ok := byid[id]; ok {
+				g.vote = &MapVote{g: g, choices: strings.Split(ss[2], ","), votes: make(map[string]int)}
+			}
+		case ss[0] == "mapvoter" && len(ss) == 4:
+			id, _ := strconv.Atoi(ss[1])
+			n, err := strconv.Atoi(ss[3])
+			if g, ok := byid[id]; ok && g.vote != nil && err == nil && n >= 0 && n < len(g.vote.choices) {
+				g.vote.votes[ss[2]] = n
+			}
+		case ss[0] == "cup" && len(ss) == 9:
+			if c := restorecup(ss[1:]); c != nil {
+				cups = append(cups, c)
+			}
+		case ss[0] == "cupmatch" && len(ss) == 10:
+			matches = append(matches, ss[1:])
+		default:
+			log.Println("bad entry in state")
+		}
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+	for _, g := range restored {
+		if g.state == Drafting || g.state == Voting && g.vote == nil {
+			for _, p := range g.who {
+				if g.mode.addplayer(p.user, g.started) {
+					g.mode.who[len(g.mode.who)-1].captain = p.captain
+				}
+			}
+			restorenotes = append(restorenotes, csprintf(
+				"{orange}{b}%s{b} #%d{r} was being drafted when the bot restarted; its players have been put back",
+				g.name, g.id))
+			continue
+		}
+		games = append(games, g)
+		if g.id >= nextgameid {
+			nextgameid = g.id + 1
+		}
+	}
+	// Players in a game that is still on aren't queued for another.
+	for _, m := range modes {
+		for i := 0; i < len(m.who); i++ {
+			if findgame(m.who[i].user, "") != nil {
+				m.who = append(m.who[:i], m.who[i+1:]...)
+				i--
+			}
+		}
+		sort.SliceStable(m.who, func(i, j int) bool { return m.who[i].added.Before(m.who[j].added) })
+	}
+	for _, ss := range matches {
+		restorematch(ss)
+	}
+	laststate = snapshot()
+	return nil
+}
+
+// Pick up where the restored state left off once the bot is back on
+// IRC: tell the channel what was lost, reopen map votes and start cup
+// matches whose games are gone.
+func resumestate() {
+	for _, s := range restorenotes {
+		irc.privmsg(channel, s)
+	}
+	restorenotes = nil
+	for _, g := range games {
+		if v := g.vote; v != nil {
+			irc.privmsg(channel, v.String())
+			after(mapvotetime, func() {
+				if g.vote == v {
+					v.close()
+				}
+			})
+		}
+	}
+	for _, c := range cups {
+		if c.started && c.champion == "" {
+			c.advance()
+		}
+	}
+}
+
+// A game from its snapshot fields, without its players, or nil.
+func restoregame(ss []string) *Game {
+	id, err := strconv.Atoi(ss[0])
+	if err != nil {
+		return nil
+	}
+	started, err := time.Parse(time.RFC3339, ss[2])
+	if err != nil {
+		return nil
+	}
+	state := Finished
+	for s, name := range statenames {
+		if name == ss[3] {
+			state = s
+		}
+	}
+	winner, _ := strconv.Atoi(ss[5])
+	m, ok := modes[strings.ToLower(ss[1])]
+	if !ok {
+		m = &Mode{name: ss[1]}
+	}
+	g := &Game{
+		id:         id,
+		mode:       m,
+		name:       ss[1],
+		started:    started,
+		state:      state,
+		reported:   ss[4] == "true",
+		winner:     winner,
+		mapname:    ss[7],
+		ladder:     ss[8] == "true",
+		prev:       make(map[string][]Player),
+		abortvotes: make(map[string]bool),
+		votes:      make(map[string]int),
+	}
+	for _, srv := range m.srvs {
+		if srv.alias() == ss[6] {
+			g.srv = srv
+		}
+	}
+	if ss[9] != "" {
+		g.teamnames = strings.Split(ss[9], ",")
+	}
+	if ss[10] != "" {
+		g.caps = strings.Split(ss[10], ",")
+	}
+	if ss[11] != "" {
+		g.needsub = strings.Split(ss[11], ",")
+	}
+	return g
+}
+
+// A cup from its snapshot fields, with its bracket laid out for its
+// entrants if it has started, or nil if its mode is gone.
+func restorecup(ss []string) *Cup {
+	m, ok := modes[strings.ToLower(ss[1])]
+	if !ok {
+		restorenotes = append(restorenotes, csprintf(
+			"{orange}{b}%s{b}{r} cup was dropped on restart: mode %s is gone", ss[0], ss[1]))
+		return nil
+	}
+	size, err := strconv.Atoi(ss[2])
+	if err != nil || size < 2 || size > maxcupsize || size&(size-1) != 0 {
+		log.Println("bad cup in state")
+		return nil
+	}
+	c := &Cup{name: ss[0], mode: m, size: size, double: ss[3] == "true", seeding: ss[4],
+		started: ss[5] == "true", champion: ss[6]}
+	if ss[7] != "" {
+		c.who = strings.Split(ss[7], ",")
+	}
+	if c.started {
+		c.build()
+	}
+	return c
+}
+
+// Restore a cup match's progress from its snapshot fields, linking it
+// to its game if that was restored.
+func restorematch(ss []string) {
+	c := findcup(ss[0])
+	num, err := strconv.Atoi(ss[1])
+	if c == nil || err != nil || num < 1 || num > len(c.matches) {
+		return
+	}
+	m := c.matches[num-1]
+	m.winner, _ = strconv.Atoi(ss[2])
+	m.held = ss[4] == "true"
+	m.slots[0].user, m.slots[0].done = ss[5], ss[6] == "true"
+	m.slots[1].user, m.slots[1].done = ss[7], ss[8] == "true"
+	id, _ := strconv.Atoi(ss[3])
+	for _, g := range games {
+		if id != 0 && g.id == id {
+			m.game, g.cupmatch = g, m
+		}
+	}
+}
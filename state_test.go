@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A restart restores games with their map votes and what !abort needs,
+// and cups with their games, just as they were.
+func TestState(t *testing.T) {
+	testbot(t)
+	ctf := &Mode{name: "ctf", nneeded: 4, teams: 2}
+	duel := &Mode{name: "duel", nneeded: 2}
+	modes["ctf"], modes["duel"] = ctf, duel
+	now := time.Now()
+	duel.addplayer("x!u@h", now)
+	who := []Player{{user: "a!u@h", team: 1}, {user: "b!u@h", team: 2}, {user: "c!u@h", team: 1}, {user: "d!u@h", team: 2}}
+	g := newgame(ctf, who)
+	g.state = Voting
+	g.vote = &MapVote{g: g, choices: []string{"q3dm6", "q3dm17"}, votes: map[string]int{"a!u@h": 1}}
+	c := &Cup{name: "spring", mode: duel, seeding: "random", who: []string{"e!u@h", "f!u@h", "g!u@h"}}
+	cups = append(cups, c)
+	within(t, c.start)
+	drafting := newgame(ctf, []Player{{user: "h!u@h"}, {user: "i!u@h"}})
+	drafting.state = Drafting
+	want := snapshot()
+	if err := os.WriteFile(statefile, want, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	games, cups, duel.who = nil, nil, nil
+	restorenotes = nil
+	if err := readstate(statefile); err != nil {
+		t.Fatal(err)
+	}
+	if len(games) != 2 {
+		t.Fatalf("restored %d games", len(games))
+	}
+	g = games[0]
+	if g.vote == nil || g.vote.votes["a!u@h"] != 1 || len(g.prev["duel"]) != 1 {
+		t.Errorf("vote %+v, prev %v", g.vote, g.prev)
+	}
+	if len(cups) != 1 || games[1].cupmatch == nil || games[1].cupmatch.game != games[1] {
+		t.Errorf("cup match not linked to its game")
+	}
+	if len(ctf.who) != 2 || len(restorenotes) != 1 || !strings.Contains(restorenotes[0], "#3") {
+		t.Errorf("draft: queue %v, notes %q", ctf.who, restorenotes)
+	}
+	ctf.who = nil
+	var b bytes.Buffer
+	for _, l := range strings.SplitAfter(string(want), "\n") {
+		if !strings.HasPrefix(l, "game") || strings.SplitN(l, "\t", 3)[1] != "3" {
+			b.WriteString(l)
+		}
+	}
+	if got := snapshot(); !bytes.Equal(got, b.Bytes()) {
+		t.Errorf("restored as:\n%s\nwant:\n%s", got, b.Bytes())
+	}
+	for len(irc.out) > 0 {
+		<-irc.out
+	}
+	within(t, resumestate)
+	if len(restorenotes) != 0 || len(irc.out) != 2 {
+		t.Errorf("resumed with %d messages, want the note and the vote", len(irc.out))
+	}
+}
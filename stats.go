@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const statsmates = 3 // Teammates shown by !stats.
+
+func stats(where, who string, args ...string) bool {
+	if len(args) > 2 {
+		sayusage(where, who, "usage: !stats [nick] [mode]")
+		return false
+	}
+	name, mode := mainname(playername(who)), ""
+	switch len(args) {
+	case 1:
+		if ismode(args[0]) {
+			mode = args[0]
+		} else {
+			name = mainname(strings.Trim(args[0], "`^_"))
+		}
+	case 2:
+		name, mode = mainname(strings.Trim(args[0], "`^_")), args[1]
+	}
+	hs := hist.player(name)
+	if mode != "" {
+		var ms []HistVal
+		for _, h := range hs {
+			if strings.EqualFold(h.mode, mode) {
+				ms = append(ms, h)
+			}
+		}
+		hs = ms
+	}
+	if len(hs) == 0 {
+		s := fmt.Sprintf("%s hasn't played any games", name)
+		if mode != "" {
+			s += " of " + mode
+		}
+		say(where, who, s)
+		return true
+	}
+	loc := zonefor(who)
+	weekago, _, _, _ := parseperiod("week", loc)
+	monthago, _, _, _ := parseperiod("month", loc)
+	permode := make(map[string]int)
+	mates := make(map[string]int)
+	var won, reported, week, month int
+	for _, h := range hs {
+		permode[h.mode]++
+		switch h.result {
+		case "win":
+			won++
+			reported++
+		case "loss", "draw":
+			reported++
+		}
+		if !h.t.Before(weekago) {
+			week++
+		}
+		if !h.t.Before(monthago) {
+			month++
+		}
+		if h.id == 0 || h.team == 0 {
+			continue
+		}
+		for _, o := range hist.game(h.id) {
+			if mate := mainname(o.nick); o.team == h.team && !strings.EqualFold(mate, name) {
+				mates[mate]++
+			}
+		}
+	}
+	ss := []string{fmt.Sprintf("%d games", len(hs))}
+	if mode == "" {
+		top := tally(permode)
+		ms := make([]string, len(top))
+		for i, v := range top {
+			ms[i] = fmt.Sprintf("%s %d", v.name, v.n)
+		}
+		ss[0] += " (" + strings.Join(ms, ", ") + ")"
+		ss = append(ss, "favourite "+top[0].name)
+	}
+	ss = append(ss, fmt.Sprintf("first %s, last %s",
+		hs[0].t.In(loc).Format("2 Jan 2006"), hs[len(hs)-1].t.In(loc).Format("2 Jan 2006")))
+	ss = append(ss, fmt.Sprintf("%d in the past week, %d in the past month", week, month))
+	if reported > 0 {
+		ss = append(ss, fmt.Sprintf("won %d of %d (%d%%)", won, reported, won*100/reported))
+	}
+	if top := tally(mates); len(top) > 0 {
+		if len(top) > statsmates {
+			top = top[:statsmates]
+		}
+		ss = append(ss, "often with "+top.String())
+	}
+	title := name
+	if mode != "" {
+		title += " in " + hs[0].mode
+	}
+	say(where, who, csprintf("{orange}{b}%s{b}{r}: %s", title, strings.Join(ss, "; ")))
+	return true
+}
+
+// Is s the name of a mode, now or in the history?
+func ismode(s string) bool {
+	if _, ok := modes[strings.ToLower(s)]; ok {
+		return true
+	}
+	return len(hist.bymode[strings.ToLower(s)]) > 0
+}
+
+// Counts sorted highest first.
+func tally(count map[string]int) Top10 {
+	top := make(Top10, 0, len(count))
+	for k, v := range count {
+		top = append(top, Top10Val{k, v})
+	}
+	sort.Sort(top)
+	return top
+}
+
+const (
+	deftop = 10 // Places shown by !top.
+	maxtop = 25 // Most places !top will show.
+)
+
+// The span of time a period names: "all", "week", "month" or "year", a
+// time back from now such as "3d", or a calendar year, month or day
+// such as "2026-09" in loc. It is from from up to but not including to,
+// and described by desc, e.g. "over the past week".
+func parseperiod(s string, loc *time.Location) (from, to time.Time, desc string, err error) {
+	now := time.Now()
+	switch strings.ToLower(s) {
+	case "all":
+		return time.Time{}, now, "of all time", nil
+	case "week":
+		return now.AddDate(0, 0, -7), now, "over the past week", nil
+	case "month":
+		return now.AddDate(0, -1, 0), now, "over the past month", nil
+	case "year":
+		return now.AddDate(-1, 0, 0), now, "over the past year", nil
+	}
+	for _, c := range []struct {
+		layout, desc string
+		next         func(time.Time) time.Time
+	}{
+		{"2006", "in 2006", func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }},
+		{"2006-01", "in January 2006", func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }},
+		{"2006-01-02", "on 2 January 2006", func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }},
+	} {
+		if t, err := time.ParseInLocation(c.layout, s, loc); err == nil {
+			return t, c.next(t), t.Format(c.desc), nil
+		}
+	}
+	d, err := parseduration(s)
+	if err != nil || d <= 0 {
+		return time.Time{}, time.Time{}, "", fmt.Errorf("%s: bad period", s)
+	}
+	return now.Add(-d), now, "over the past " + s, nil
+}
+
+// Players by games played, counting aliases as their main names, or if
+// bymode, modes by games rather than by players' entries, from from up
+// to to, optionally in one mode. Old entries without a game ID are
+// taken to be from the same game if they have the same mode and time.
+func findtop(bymode bool, mode string, from, to time.Time) Top10 {
+	count := make(map[string]int)
+	seen := make(map[string]bool)
+	for _, h := range hist.since(from) {
+		if !h.t.Before(to) {
+			break
+		}
+		if mode != "" && !strings.EqualFold(h.mode, mode) {
+			continue
+		}
+		if !bymode {
+			count[mainname(h.nick)]++
+			continue
+		}
+		game := fmt.Sprintf("%d", h.id)
+		if h.id == 0 {
+			game = h.mode + "\t" + h.t.String()
+		}
+		if !seen[game] {
+			seen[game] = true
+			count[h.mode]++
+		}
+	}
+	return tally(count)
+}
+
+func top(where, who string, args ...string) bool {
+	usage := "usage: !top [players|modes] [mode] [period] [n] (period: all, week, month, year, 3d, 2026, 2026-09, 2026-09-01)"
+	bymode, mode, n := false, "", deftop
+	period := "all"
+	for _, a := range args {
+		if i, err := strconv.Atoi(a); err == nil && i > 0 && i <= maxtop {
+			n = i
+			continue
+		}
+		switch strings.ToLower(a) {
+		case "players":
+			bymode = false
+			continue
+		case "modes":
+			bymode = true
+			continue
+		}
+		if _, _, _, err := parseperiod(a, time.UTC); err == nil {
+			period = a
+		} else if ismode(a) {
+			mode = a
+		} else {
+			sayusage(where, who, usage)
+			return false
+		}
+	}
+	from, to, desc, _ := parseperiod(period, zonefor(who))
+	t := findtop(bymode, mode, from, to)
+	if len(t) > n {
+		t = t[:n]
+	}
+	what := "players"
+	if bymode {
+		what = "modes"
+	}
+	if mode != "" {
+		what += " in " + mode
+	}
+	if len(t) == 0 {
+		say(where, who, fmt.Sprintf("no games %s", desc))
+		return true
+	}
+	say(where, who, fmt.Sprintf("top %d %s %s: %s", n, what, desc, t))
+	return true
+}
+
+// !top with fixed arguments, for the old fixed leaderboards.
+func topof(args ...string) func(string, string, ...string) bool {
+	return func(where, who string, _ ...string) bool {
+		return top(where, who, args...)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseperiod(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	now := time.Now()
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, loc) }
+	for _, c := range []struct {
+		s        string
+		from, to time.Time // Zero from is the start of time; zero to is now.
+		bad      bool
+	}{
+		{s: "all"},
+		{s: "Week", from: now.AddDate(0, 0, -7)},
+		{s: "month", from: now.AddDate(0, -1, 0)},
+		{s: "year", from: now.AddDate(-1, 0, 0)},
+		{s: "3d", from: now.Add(-72 * time.Hour)},
+		{s: "1w12h", from: now.Add(-180 * time.Hour)},
+		{s: "2026", from: day(2026, 1, 1), to: day(2027, 1, 1)},
+		{s: "2026-02", from: day(2026, 2, 1), to: day(2026, 3, 1)},
+		{s: "2026-12-31", from: day(2026, 12, 31), to: day(2027, 1, 1)},
+		{s: "0h", bad: true},
+		{s: "-3d", bad: true},
+		{s: "2026-13", bad: true},
+		{s: "fortnight", bad: true},
+	} {
+		from, to, _, err := parseperiod(c.s, loc)
+		if c.bad {
+			if err == nil {
+				t.Errorf("%q: parsed", c.s)
+			}
+			continue
+		}
+		if c.to.IsZero() {
+			c.to = now
+		}
+		near := func(a, b time.Time) bool { return a.Sub(b).Abs() < time.Minute }
+		if err != nil || !near(from, c.from) || !near(to, c.to) {
+			t.Errorf("%q: %v to %v, %v; want %v to %v", c.s, from, to, err, c.from, c.to)
+		}
+	}
+}
+
+// !stats counts the past week and month as !top does.
+func TestStatsPeriods(t *testing.T) {
+	testbot(t)
+	v := *vol
+	*vol = 3
+	t.Cleanup(func() { *vol = v })
+	now := time.Now()
+	var hs []HistVal
+	for i, ago := range []time.Duration{time.Hour, 6 * 24 * time.Hour, 8 * 24 * time.Hour, 29 * 24 * time.Hour, 40 * 24 * time.Hour} {
+		hs = append(hs, HistVal{v: histversion, t: now.Add(-ago), mode: "ctf", nick: "alice", id: i + 1})
+	}
+	if err := hist.add(hs); err != nil {
+		t.Fatal(err)
+	}
+	stats("#pickup", "alice!u@h", "alice")
+	var out strings.Builder
+	for len(irc.out) > 0 {
+		out.WriteString(<-irc.out)
+	}
+	if !strings.Contains(out.String(), "2 in the past week, 4 in the past month") {
+		t.Errorf("stats: %s", out.String())
+	}
+}
+
+// Modes are ranked by games, however many players each had, and old
+// entries without a game ID are grouped by mode and time.
+func TestFindtopModes(t *testing.T) {
+	testbot(t)
+	now := time.Now().Truncate(time.Second)
+	var hs []HistVal
+	for i, h := range []struct {
+		mode string
+		id   int
+		ago  time.Duration
+	}{
+		{"ctf", 1, 3 * time.Hour}, {"ctf", 1, 3 * time.Hour}, {"ctf", 1, 3 * time.Hour}, {"ctf", 1, 3 * time.Hour},
+		{"duel", 0, 2 * time.Hour}, {"duel", 0, 2 * time.Hour},
+		{"duel", 0, time.Hour}, {"duel", 0, time.Hour},
+	} {
+		hs = append(hs, HistVal{v: histversion, t: now.Add(-h.ago), mode: h.mode, nick: string(rune('a' + i)), id: h.id})
+	}
+	if err := hist.add(hs); err != nil {
+		t.Fatal(err)
+	}
+	if got := findtop(true, "", time.Time{}, now).String(); got != "duel (2), ctf (1)" {
+		t.Errorf("got %q", got)
+	}
+	if got := findtop(false, "ctf", time.Time{}, now); len(got) != 4 {
+		t.Errorf("got %v", got)
+	}
+}
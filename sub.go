@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+func needsub(where, who string, args ...string) bool {
+	if len(args) > 1 {
+		sayusage(where, who, "usage: !needsub [id|mode]")
+		return false
+	}
+	game := ""
+	if len(args) == 1 {
+		game = args[0]
+	}
+	g := findgame(who, game)
+	if g == nil || g.state < Playing {
+		sayusage(where, who, "you aren't in a game in progress")
+		return false
+	}
+	for _, u := range g.needsub {
+		if u == who {
+			sayusage(where, who, "you have already asked for a sub")
+			return false
+		}
+	}
+	g.needsub = append(g.needsub, who)
+	nick, _, _ := splituserstring(who)
+	broadcast(csprintf("{pink}{b}%s{b} #%d needs a sub for {b}%s{b}; say {b}!sub %s{b} in {b}%s{b} to play!",
+		g.name, g.id, nick, nick, channel))
+	return true
+}
+
+// Replace a player who asked for a sub with who.
+func sub(where, who string, args ...string) bool {
+	if len(args) != 1 {
+		sayusage(where, who, "usage: !sub nick")
+		return false
+	}
+	for i := len(games) - 1; i >= 0; i-- {
+		g := games[i]
+		if !g.active() {
+			continue
+		}
+		for j, leaver := range g.needsub {
+			nick, _, _ := splituserstring(leaver)
+			if !strings.EqualFold(nick, args[0]) {
+				continue
+			}
+			if g.playerindex(who) >= 0 {
+				sayusage(where, who, "you are already in that game")
+				return false
+			}
+			g.needsub = append(g.needsub[:j], g.needsub[j+1:]...)
+			g.replaceplayer(leaver, who)
+			return true
+		}
+	}
+	sayusage(where, who, fmt.Sprintf("%s hasn't asked for a sub", args[0]))
+	return false
+}
+
+// Put who in leaver's place in game g, its history and its result. A
+// sub for a captain takes over as captain.
+func (g *Game) replaceplayer(leaver, who string) {
+	i := g.playerindex(leaver)
+	if i < 0 {
+		return
+	}
+	g.who[i].user = who
+	oldnick, _, _ := splituserstring(leaver)
+	nick, _, _ := splituserstring(who)
+	for c := range g.caps {
+		if strings.EqualFold(g.caps[c], oldnick) {
+			g.caps[c] = nick
+		}
+	}
+	delete(g.votes, leaver)
+	delete(g.abortvotes, leaver)
+	oldname, name := mainname(playername(leaver)), mainname(playername(who))
+	err := hist.edit(g.id, func(h *HistVal) bool {
+		if strings.EqualFold(h.nick, oldname) {
+			h.nick = name
+			h.subfor = oldname
+			h.account = irc.account(who)
+		}
+		return true
+	})
+	if err != nil {
+		log.Println(err)
+	}
+
+	// The sub is busy now.
+	update := false
+	for _, mm := range modes {
+		update = mm.removeplayer(who) || update
+	}
+	if update {
+		updatetopic()
+	}
+	irc.privmsg(channel, csprintf("{orange}%s{r} subs for {orange}%s{r} in {orange}{b}%s{b} #%d",
+		nick, oldnick, g.name, g.id))
+	irc.privmsg(nick, csprintf("{orange}{b}%s{b} #%d {r}-> %s {r}<- you are subbing for {orange}%s",
+		g.name, g.id, g.connectstring(), oldnick))
+}
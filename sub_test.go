@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// A sub for a captain takes over as captain in the game and its
+// history, whatever the case of the names in the history.
+func TestReplaceplayer(t *testing.T) {
+	testbot(t)
+	m := &Mode{name: "ctf", nneeded: 4, teams: 2}
+	who := []Player{{user: "Alice!u@h", team: 1, captain: true}, {user: "bob!u@h", team: 1},
+		{user: "carol!u@h", team: 2, captain: true}, {user: "dave!u@h", team: 2}}
+	g := newgame(m, who)
+	g.caps = []string{"Alice", "carol"}
+	if err := hist.add([]HistVal{
+		{v: histversion, t: time.Now(), mode: "ctf", nick: "alice", team: 1, id: g.id, captain: true},
+		{v: histversion, t: time.Now(), mode: "ctf", nick: "bob", team: 1, id: g.id},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		leaver, sub string
+		captain     bool
+	}{
+		{"Alice!u@h", "erin!u@h", true},
+		{"bob!u@h", "frank!u@h", false},
+	} {
+		g.replaceplayer(c.leaver, c.sub)
+		nick, _, _ := splituserstring(c.sub)
+		u := g.who[g.playerindex(c.sub)]
+		if u.captain != c.captain || containsfold(g.caps, nick) != c.captain {
+			t.Errorf("%s for %s: captain %t, captains %v", c.sub, c.leaver, u.captain, g.caps)
+		}
+		hs := hist.player(nick)
+		if len(hs) != 1 || hs[0].captain != c.captain || hs[0].subfor == "" {
+			t.Errorf("%s for %s: history %+v", c.sub, c.leaver, hs)
+		}
+	}
+}